@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// backendPolicyKind is the per instance group entity that configures how
+// replicas are weighted and limited in proxysql
+const backendPolicyKind string = "chester_backend_policy"
+
+// weightPerVCPU is the proxysql weight given to each vCPU of a replica's tier
+const weightPerVCPU float64 = 100
+
+// backendPolicy is stored per instance group to override the connection
+// limit and weight worked out from a replica's tier
+type backendPolicy struct {
+	// MaxConnections is the proxysql max_connections for new replicas,
+	// zero works it out from the replica's tier and flags
+	MaxConnections int64
+	// Weight is the proxysql weight for every replica, zero works it out from the replica's tier
+	Weight int64
+	// ConnectionShare is the share of a replica's max_connections that proxysql
+	// may use, split across the proxysql pods, defaults to 0.8
+	ConnectionShare float64
+}
+
+// getBackendPolicy gets the backend policy for an instance group
+func getBackendPolicy(instanceGroup string) (backendPolicy, error) {
+	policy := backendPolicy{
+		ConnectionShare: 0.8,
+	}
+	err := getGroupSetting(backendPolicyKind, instanceGroup, &policy)
+	return policy, err
+}
+
+// machineTierPattern matches predefined tiers like db-n1-standard-4
+var machineTierPattern = regexp.MustCompile(`^db-([a-z0-9]+)-(standard|highmem|highcpu)-(\d+)$`)
+
+// customTierPattern matches custom tiers like db-custom-4-15360
+var customTierPattern = regexp.MustCompile(`^db-custom-(\d+)-(\d+)$`)
+
+// tierResources returns the vCPUs and memory in GB of a cloud sql tier
+func tierResources(tier string) (float64, float64, error) {
+	switch tier {
+	case "db-f1-micro":
+		return 0.2, 0.6, nil
+	case "db-g1-small":
+		return 0.5, 1.7, nil
+	}
+	if m := customTierPattern.FindStringSubmatch(tier); m != nil {
+		cpus, _ := strconv.ParseFloat(m[1], 64)
+		memoryMB, _ := strconv.ParseFloat(m[2], 64)
+		return cpus, memoryMB / 1024, nil
+	}
+	if m := machineTierPattern.FindStringSubmatch(tier); m != nil {
+		cpus, _ := strconv.ParseFloat(m[3], 64)
+		// memory per vCPU for n1, other families are a little bigger
+		perCPU := map[string]float64{"standard": 3.75, "highmem": 6.5, "highcpu": 0.9}[m[2]]
+		if m[1] != "n1" {
+			perCPU = map[string]float64{"standard": 4, "highmem": 8, "highcpu": 1}[m[2]]
+		}
+		return cpus, cpus * perCPU, nil
+	}
+	return 0, 0, fmt.Errorf("unknown tier %s", tier)
+}
+
+// instanceMaxConnections returns the max_connections of a cloud sql instance,
+// from its flags if it's set, otherwise the cloud sql default for its memory.
+func instanceMaxConnections(instance *sqladmin.DatabaseInstance) (int64, error) {
+	for _, flag := range instance.Settings.DatabaseFlags {
+		if flag.Name == "max_connections" {
+			return strconv.ParseInt(flag.Value, 10, 64)
+		}
+	}
+	_, memoryGB, err := tierResources(instance.Settings.Tier)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case memoryGB < 1:
+		return 250, nil
+	case memoryGB < 3.75:
+		return 1000, nil
+	}
+	return 4000, nil
+}
+
+// backendMaxConnections works out the proxysql max_connections for a replica.
+// proxysql applies it per pod, so the replica's share is split across the
+// running proxysql pods.
+func backendMaxConnections(instanceGroup string, instance *sqladmin.DatabaseInstance) (int64, error) {
+	policy, err := getBackendPolicy(instanceGroup)
+	if err != nil {
+		return 0, err
+	}
+	if policy.MaxConnections > 0 {
+		return policy.MaxConnections, nil
+	}
+	maxConnections, err := instanceMaxConnections(instance)
+	if err != nil {
+		return 0, err
+	}
+	pods, err := getDeploymentPods("instancegroup", instanceGroup, "proxysql")
+	if err != nil {
+		return 0, err
+	}
+	podCount := len(pods)
+	if podCount == 0 {
+		podCount = 1
+	}
+	conns := int64(float64(maxConnections) * policy.ConnectionShare / float64(podCount))
+	if conns < 1 {
+		conns = 1
+	}
+	return conns, nil
+}
+
+// backendWeight works out the proxysql weight for a replica from its vCPUs
+func backendWeight(policy backendPolicy, instance *sqladmin.DatabaseInstance) int64 {
+	if policy.Weight > 0 {
+		return policy.Weight
+	}
+	cpus, _, err := tierResources(instance.Settings.Tier)
+	if err != nil {
+		return int64(weightPerVCPU)
+	}
+	weight := int64(cpus * weightPerVCPU)
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+// serverEntryPattern matches a server in the mysql_servers list of a rendered proxysql.cnf
+var serverEntryPattern = regexp.MustCompile(`\{ address="([^"]*)" ,[^}]*use_ssl=\d+ \}`)
+
+// withServerWeights adds a weight to each server in a rendered proxysql.cnf.
+// Servers without a weight are left at the proxysql default of 1.
+func withServerWeights(cnf []byte, weights map[string]int64) []byte {
+	return serverEntryPattern.ReplaceAllFunc(cnf, func(entry []byte) []byte {
+		address := string(serverEntryPattern.FindSubmatch(entry)[1])
+		weight, ok := weights[address]
+		if !ok {
+			return entry
+		}
+		return []byte(fmt.Sprintf("%s, weight=%d }", strings.TrimSuffix(string(entry), " }"), weight))
+	})
+}
+
+// configMapWeights returns the weight of every replica for the configmap.
+// Replicas in startWeights are joining with a ramp, so they start there
+// instead of at their full weight after a rolling restart.
+func configMapWeights(instanceGroup string, startWeights map[string]int64) (map[string]int64, error) {
+	weights, err := backendWeights(instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	for ip, start := range startWeights {
+		if full, ok := weights[ip]; ok && start < full {
+			weights[ip] = start
+		}
+	}
+	return weights, nil
+}
+
+// backendWeights returns the proxysql weight of every replica of the
+// instance group's master, keyed by private IP.
+func backendWeights(instanceGroup string) (map[string]int64, error) {
+	policy, err := getBackendPolicy(instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	master, err := getInstance(ctx, instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	weights := map[string]int64{}
+	for _, name := range master.ReplicaNames {
+		replica, err := findInstance(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if replica == nil {
+			continue
+		}
+		if ip := getPrivateIP(replica.IpAddresses); ip != "" {
+			weights[ip] = backendWeight(policy, replica)
+		}
+	}
+	return weights, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestTierResources(t *testing.T) {
+	tests := []struct {
+		tier        string
+		cpus, memGB float64
+		wantErr     bool
+	}{
+		{tier: "db-f1-micro", cpus: 0.2, memGB: 0.6},
+		{tier: "db-g1-small", cpus: 0.5, memGB: 1.7},
+		{tier: "db-custom-4-15360", cpus: 4, memGB: 15},
+		{tier: "db-n1-standard-4", cpus: 4, memGB: 15},
+		{tier: "db-n1-highmem-2", cpus: 2, memGB: 13},
+		{tier: "db-n2-highcpu-8", cpus: 8, memGB: 8},
+		{tier: "db-n2-standard-2", cpus: 2, memGB: 8},
+		{tier: "db-unknown", wantErr: true},
+		{tier: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tier, func(t *testing.T) {
+			cpus, memGB, err := tierResources(tt.tier)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if cpus != tt.cpus || memGB != tt.memGB {
+				t.Errorf("got %v vCPUs and %vGB, want %v and %vGB", cpus, memGB, tt.cpus, tt.memGB)
+			}
+		})
+	}
+}
+
+func TestWithServerWeights(t *testing.T) {
+	cnf := `mysql_servers =
+(
+  { address="10.0.0.1" , port=3306 , hostgroup=10, max_connections=100 , use_ssl=1 },
+  { address="10.0.0.2" , port=3306 , hostgroup=20, max_connections=100 , use_ssl=1 }
+)`
+	want := `mysql_servers =
+(
+  { address="10.0.0.1" , port=3306 , hostgroup=10, max_connections=100 , use_ssl=1 },
+  { address="10.0.0.2" , port=3306 , hostgroup=20, max_connections=100 , use_ssl=1, weight=25 }
+)`
+	got := string(withServerWeights([]byte(cnf), map[string]int64{"10.0.0.2": 25, "10.0.0.3": 50}))
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
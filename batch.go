@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+// batchReplica is one of the replicas an incident is adding or removing in
+// the current loop. The incident entity only has room for one replica, so
+// the batch lives on the incident details.
+type batchReplica struct {
+	// Name is the replica's instance name
+	Name string
+	// Region is the region the replica is created in
+	Region string
+	// Zone is the zone the replica is created in, empty lets cloud sql pick
+	Zone string
+	// OperationID is the sqladmin operation for the replica's create or delete
+	OperationID string
+	// IPAddress is the replica's private IP
+	IPAddress string
+	// Pooled is set when the replica was a warm or parked replica started
+	// rather than created
+	Pooled bool
+	// Pool is the pool a Pooled replica was started from, so a rollback can put it back
+	Pool string
+}
+
+// batchMu serializes batch updates from the goroutines working on a batch,
+// so their transactions on the incident details don't contend
+var batchMu sync.Mutex
+
+// getBatch returns the replicas the incident is working on in this loop.
+// Incidents started before batches existed only have the single replica on
+// the incident, which is stored as a batch of one so later updates find it.
+func getBatch(incident *models.DataStoreIncident) ([]batchReplica, error) {
+	details, err := getIncidentDetails(incident.IncidentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(details.Batch) > 0 || incident.LastReadReplicaName == "" {
+		return details.Batch, nil
+	}
+	batch := []batchReplica{{
+		Name:        incident.LastReadReplicaName,
+		OperationID: incident.OperationID,
+		IPAddress:   incident.LastIPAddress,
+	}}
+	return batch, setBatch(incident.IncidentID, batch)
+}
+
+// setBatch replaces the incident's batch
+func setBatch(incidentID string, batch []batchReplica) error {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	_, err := updateIncidentDetails(incidentID, func(details *incidentDetails) {
+		details.Batch = batch
+	})
+	return err
+}
+
+// updateBatchReplica applies update to one replica of the incident's batch
+func updateBatchReplica(incidentID, name string, update func(replica *batchReplica)) error {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	_, err := updateIncidentDetails(incidentID, func(details *incidentDetails) {
+		for i := range details.Batch {
+			if details.Batch[i].Name == name {
+				update(&details.Batch[i])
+			}
+		}
+	})
+	return err
+}
+
+// forEachInBatch runs fn on every replica of the batch at the same time and
+// returns the first error. The context passed to fn is cancelled once any
+// of them fails, so the rest stop waiting.
+func forEachInBatch(ctx context.Context, batch []batchReplica, fn func(ctx context.Context, replica batchReplica) error) error {
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(batch))
+	var wg sync.WaitGroup
+	for i, replica := range batch {
+		wg.Add(1)
+		go func(i int, replica batchReplica) {
+			defer wg.Done()
+			errs[i] = fn(batchCtx, replica)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+	// prefer the error that started the cancel over the ones it caused
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchNames returns the names of the replicas in a batch
+func batchNames(batch []batchReplica) []string {
+	names := []string{}
+	for _, replica := range batch {
+		names = append(names, replica.Name)
+	}
+	return names
+}
+
+// alertStepSize reads step_size from the alert's documentation, which lets
+// an alert ask for more replicas per loop than the scaling policy. Zero
+// means the alert didn't set one.
+func alertStepSize(incident models.DataStoreIncident) int {
+	doc := struct {
+		StepSize int `json:"step_size"`
+	}{}
+	if incident.Documentation.Content == "" {
+		return 0
+	}
+	if err := json.Unmarshal([]byte(incident.Documentation.Content), &doc); err != nil {
+		return 0
+	}
+	return doc.StepSize
+}
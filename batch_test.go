@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestForEachInBatch(t *testing.T) {
+	closed := permanent(fmt.Errorf("incident 1: %w", errIncidentClosed))
+	batch := []batchReplica{{Name: "waiting"}, {Name: "failing"}}
+	err := forEachInBatch(context.Background(), batch, func(ctx context.Context, replica batchReplica) error {
+		if replica.Name == "failing" {
+			return closed
+		}
+		// a sibling stuck waiting gives up with a wrapped cancel once the other fails
+		<-ctx.Done()
+		return fmt.Errorf("stopped waiting on operation op-1: %w", ctx.Err())
+	})
+	if !errors.Is(err, errIncidentClosed) || !isPermanent(err) {
+		t.Errorf("got %v, want the permanent closed error", err)
+	}
+}
+
+func TestForEachInBatchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := forEachInBatch(ctx, []batchReplica{{Name: "a"}}, func(ctx context.Context, replica batchReplica) error {
+		return fmt.Errorf("stopped waiting on operation op-1: %w", ctx.Err())
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want a cancel", err)
+	}
+}
@@ -32,6 +32,15 @@ func getIncidentState(id string) (string, error) {
 	}
 }
 
+// getIncident gets the latest copy of an incident from datastore
+func getIncident(id string) (models.DataStoreIncident, error) {
+	dsi := models.DataStoreIncident{}
+	key := datastore.NameKey("incident", id, nil)
+	key.Namespace = "chester"
+	err := datastoreClient.Get(ctx, key, &dsi)
+	return dsi, err
+}
+
 // updateOperationID updates the current operation id from sqladminsvc
 // this is used in case the app goes down during a sqlupdate command
 func updateOperationID(id, operation string) error {
@@ -78,20 +87,25 @@ func updateLastIPAddress(id, ipAddress string) error {
 
 // addReplicaToDatastore adds an IP address to the datastore config
 // this is done by adding a ProxySqlMySqlServer struct to the list of
-// read replicas
-func addReplicaToDatastore(instanceGroup, ipAddress string) error {
+// read replicas. Adding an IP that is already in the config does nothing.
+func addReplicaToDatastore(instanceGroup, ipAddress string, hostgroup int, maxConnections int64) error {
 	_, err := datastoreClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
 		psqlconfig, err := getProxySQLConfig(instanceGroup)
 		if err != nil {
 			return err
 		}
+		for _, server := range psqlconfig.MySqlServers {
+			if server.Address == ipAddress {
+				log.Debugf("%s is already in the proxysql config for %s", ipAddress, instanceGroup)
+				return nil
+			}
+		}
 		// TODO: Once proxysql adds instance:ssl config we can add the proxysql config stuff here
 		newMySqlServer := models.ProxySqlMySqlServer{
-			Address:   ipAddress,
-			Port:      3306,
-			Hostgroup: psqlconfig.ReadHostGroup,
-			// TODO: add dynamic max conns
-			MaxConnections: 100,
+			Address:        ipAddress,
+			Port:           3306,
+			Hostgroup:      hostgroup,
+			MaxConnections: maxConnections,
 			Comment:        models.AddedByChester,
 			UseSSL:         psqlconfig.UseSSL,
 		}
@@ -131,6 +145,30 @@ func updateLastReadReplica(id, replicaName string) error {
 	return err
 }
 
+// clearLastReplica clears the replica name, operation and ip address from the
+// incident once we're done with that replica, so the next loop starts fresh.
+func clearLastReplica(id string) error {
+	_, err := datastoreClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		dsi := &models.DataStoreIncident{}
+		log.Debugf("clearing last replica from incident %s", id)
+		key := datastore.NameKey("incident", id, nil)
+		key.Namespace = "chester"
+		if err := tx.Get(key, dsi); err != nil {
+			log.Debugln("Error getting instance group key", err.Error())
+			return err
+		}
+		dsi.LastReadReplicaName = ""
+		dsi.OperationID = ""
+		dsi.LastIPAddress = ""
+		if _, err := tx.Put(key, dsi); err != nil {
+			log.Debugln("Error putting instance group key", err.Error())
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
 // updateLastProcess stores the last process in datastore, in case of a restart
 // we aren't replicating work.
 func updateLastProcess(id, process string) error {
@@ -171,8 +209,8 @@ func getProxySQLConfig(instanceGroup string) (*models.ProxySqlConfig, error) {
 	return psqlConfig, err
 }
 
-// delete incident removes the incident from datastore, this should only be called
-// during the closure of an incident
+// delete incident removes the incident and its details from datastore, this should
+// only be called during the closure of an incident
 func deleteIncident(incidentID string) (string, error) {
 	e := datastore.NewQuery("incident").Namespace("chester").Filter("IncidentID=", incidentID)
 	iter := datastoreClient.Run(ctx, e)
@@ -184,11 +222,12 @@ func deleteIncident(incidentID string) (string, error) {
 			err = datastoreClient.Delete(ctx, incidentKey)
 			if err != nil {
 				log.Errorln(err)
+				return "", err
 			}
-			return "", err
+			return "", deleteIncidentDetails(incidentID)
 		case it.Done:
 			log.Debugln("No more things to iterate over")
-			return "", nil
+			return "", deleteIncidentDetails(incidentID)
 		default:
 			log.WithField("event", "retrieving the incident to remove").Error(err)
 			return "", nil
@@ -257,6 +296,20 @@ func getChesterMetaData(instanceGroup string) (models.ChesterMetaData, error) {
 	return chesterMetaData, err
 }
 
+// getInstanceGroups returns the name of every instance group with a proxysql config
+func getInstanceGroups() ([]string, error) {
+	q := datastore.NewQuery("proxysqlconfig").Namespace("chester").KeysOnly()
+	keys, err := datastoreClient.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, key.Name)
+	}
+	return groups, nil
+}
+
 // generateChesterKey generates a proxysql config key in the
 // chester namespace with the instancegroup as the ID
 // TODO: rename this to better reflect what it does
@@ -266,9 +319,111 @@ func generateChesterKey(instanceGroup string) *datastore.Key {
 	return key
 }
 
+// generateGroupSettingKey creates a key for a per instance group setting,
+// stored as a child of the group's proxysql config like the metadata
+func generateGroupSettingKey(kind, instanceGroup string) *datastore.Key {
+	key := datastore.NameKey(kind, instanceGroup, generateChesterKey(instanceGroup))
+	key.Namespace = "chester"
+	return key
+}
+
+// getGroupSetting loads a per instance group setting into dst. Groups without
+// the setting leave dst untouched, so callers fill dst with defaults first.
+func getGroupSetting(kind, instanceGroup string, dst interface{}) error {
+	err := datastoreClient.Get(ctx, generateGroupSettingKey(kind, instanceGroup), dst)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
 // generateMetaDataKey creates a key with a relation to a parent key
 func generateMetaDataKey(parent *datastore.Key) *datastore.Key {
 	key := datastore.NameKey(models.MetaData, parent.Name, parent)
 	key.Namespace = "chester"
 	return key
 }
+
+// incidentDetailsKind is the kind used for the daemon's own bookkeeping on an
+// incident. The incident entity is shared with GCF and the API, so anything
+// the daemon needs to remember beyond models.DataStoreIncident lives here.
+const incidentDetailsKind string = "incident_details"
+
+// incidentDetails holds daemon side state for an incident, keyed by the incident ID
+type incidentDetails struct {
+	// DeliveryAttempts is the number of times processing the incident has failed
+	DeliveryAttempts int
+	// LastError is the error from the most recent failed attempt
+	LastError string `datastore:",noindex"`
+	// CompensatedStep is the step whose failure started a rollback
+	CompensatedStep string
+	// CompensationReason is the error that started a rollback
+	CompensationReason string `datastore:",noindex"`
+	// VictimPolicy is the scale down policy that picked the replica to remove
+	VictimPolicy string
+	// VictimReplica is the replica the scale down policy picked
+	VictimReplica string
+	// VictimReason is why the scale down policy picked the replica
+	VictimReason string `datastore:",noindex"`
+	// Batch is the set of replicas being added or removed in the current loop
+	Batch []batchReplica
+	// RampReplica is the first replica of the batch being ramped up
+	RampReplica string
+	// RampStep is the ramp step RampReplica is on
+	RampStep int
+	// StepCount is the number of replicas added or removed since the last cooldown
+	StepCount int
+	// StepLastReplica is the first replica of the last batch counted in StepCount
+	StepLastReplica string
+	// SQLAdminRetries is the number of sqladmin calls retried while handling the incident
+	SQLAdminRetries int
+	// LastSQLAdminRetry describes the most recent sqladmin call that needed retries
+	LastSQLAdminRetry string `datastore:",noindex"`
+	// OperationProgress is the latest progress of the sqladmin operation being waited on
+	OperationProgress string `datastore:",noindex"`
+}
+
+// generateIncidentDetailsKey creates the incident details key for an incident
+func generateIncidentDetailsKey(id string) *datastore.Key {
+	key := datastore.NameKey(incidentDetailsKind, id, nil)
+	key.Namespace = "chester"
+	return key
+}
+
+// getIncidentDetails gets the daemon's details for an incident,
+// returning empty details if none have been stored yet.
+func getIncidentDetails(id string) (incidentDetails, error) {
+	details := incidentDetails{}
+	err := datastoreClient.Get(ctx, generateIncidentDetailsKey(id), &details)
+	if err == datastore.ErrNoSuchEntity {
+		return details, nil
+	}
+	return details, err
+}
+
+// deleteIncidentDetails removes the daemon's details for an incident once
+// nothing will pick the incident up again
+func deleteIncidentDetails(id string) error {
+	err := datastoreClient.Delete(ctx, generateIncidentDetailsKey(id))
+	if err != nil {
+		log.Errorf("failed to delete incident details for %s: %s", id, err.Error())
+	}
+	return err
+}
+
+// updateIncidentDetails applies update to the incident details in a transaction,
+// creating them if they don't exist yet.
+func updateIncidentDetails(id string, update func(details *incidentDetails)) (incidentDetails, error) {
+	details := incidentDetails{}
+	_, err := datastoreClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		details = incidentDetails{}
+		key := generateIncidentDetailsKey(id)
+		if err := tx.Get(key, &details); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		update(&details)
+		_, err := tx.Put(key, &details)
+		return err
+	})
+	return details, err
+}
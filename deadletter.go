@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+// deadLettered is the LastProcess of an incident the daemon gave up on. It's
+// kept with its details so it can be looked at, but never run again.
+const deadLettered string = "dead_lettered"
+
+// deadLetterTopic is where incidents that keep failing are published, nil if not configured
+var deadLetterTopic *pubsub.Topic
+
+// maxDeliveryAttempts is the number of failed attempts before an incident is dead lettered
+var maxDeliveryAttempts int
+
+// ackMaxExtension is the longest we'll hold on to a message before pubsub redelivers it
+var ackMaxExtension time.Duration
+
+// permanentError marks a failure that retrying the incident won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent wraps an error so the incident is not retried
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent checks whether an error was wrapped with permanent
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// detailsID is the incident details ID a message's failed attempts are kept under.
+// Messages without an incident, like restarts, are tracked by message ID
+// which stays the same across redeliveries.
+func detailsID(m *pubsub.Message, incidentID string) string {
+	if incidentID == "" {
+		return "message-" + m.ID
+	}
+	return incidentID
+}
+
+// retryOrDeadLetter records a failed attempt at an incident. Retryable failures
+// are nacked straight away and the subscription's retry policy decides when
+// pubsub redelivers them, so a failing incident doesn't hold one of the
+// outstanding message slots. Incidents that fail permanently or too many times
+// are marked dead lettered, published to the dead letter topic and acked.
+func retryOrDeadLetter(ctx context.Context, m *pubsub.Message, incidentID string, err error) {
+	funclog := log.WithFields(log.Fields{
+		"func":     "retryOrDeadLetter",
+		"incident": incidentID,
+	})
+	id := detailsID(m, incidentID)
+	details, recordErr := updateIncidentDetails(id, func(details *incidentDetails) {
+		details.DeliveryAttempts++
+		details.LastError = err.Error()
+	})
+	if recordErr != nil {
+		funclog.Errorf("failed to record failed attempt: %s", recordErr.Error())
+		m.Nack()
+		return
+	}
+	if !isPermanent(err) && details.DeliveryAttempts < maxDeliveryAttempts {
+		funclog.Warnf("attempt %d failed with error %s, nacking", details.DeliveryAttempts, err.Error())
+		m.Nack()
+		return
+	}
+	funclog.Errorf("giving up on incident after %d attempts: %s", details.DeliveryAttempts, err.Error())
+	sendMessages([]byte(fmt.Sprintf("Giving up on incident after %d attempts \n error: %s \n IncidentID: %s \n Project: %s", details.DeliveryAttempts, err.Error(), incidentID, projectID)))
+	// mark it first, so neither a redelivery nor a restart picks it up again
+	if incidentID != "" {
+		markErr := updateLastProcess(incidentID, deadLettered)
+		if markErr != nil && markErr != datastore.ErrNoSuchEntity {
+			funclog.Errorf("failed to mark incident dead lettered: %s", markErr.Error())
+			m.Nack()
+			return
+		}
+	}
+	if deadLetterTopic != nil {
+		result := deadLetterTopic.Publish(ctx, &pubsub.Message{
+			Data: m.Data,
+			Attributes: map[string]string{
+				"incident_id": incidentID,
+				"attempts":    strconv.Itoa(details.DeliveryAttempts),
+				"error":       err.Error(),
+			},
+		})
+		if _, pubErr := result.Get(ctx); pubErr != nil {
+			funclog.Errorf("failed to publish to dead letter topic: %s", pubErr.Error())
+			m.Nack()
+			return
+		}
+	}
+	m.Ack()
+	// incidents keep their details for whoever looks into them, messages
+	// without an incident have nothing left to look at
+	if incidentID == "" {
+		if err := deleteIncidentDetails(id); err != nil {
+			funclog.Errorf("failed to clean up message details: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaDrain means the replicas picked for removal are being drained of
+// connections before they're removed from the proxysql config.
+const replicaDrain string = "replica_drain"
+
+// drainPollInterval is how often connection counts are checked while draining
+const drainPollInterval = 5 * time.Second
+
+// drainReplica marks the batch's replicas OFFLINE_SOFT on every proxysql pod,
+// so no new connections are routed to them, and waits for the connections in
+// use to reach zero or the group's drain timeout to pass. The replicas are
+// drained in parallel and only removed from the proxysql config in datastore
+// once every drain is over, so they go out in one config change. If the
+// proxysql admin interface can't be reached, the drain is skipped.
+func drainReplica(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":     "drainReplica",
+		"incident": incident.IncidentID,
+	})
+	policy, err := getScaleDownPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get scale down policy: %s", err.Error())
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	if policy.DrainTimeoutSeconds > 0 {
+		timeout := time.Duration(policy.DrainTimeoutSeconds) * time.Second
+		err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+			if replica.IPAddress == "" {
+				return nil
+			}
+			err := drainConnections(ctx, incident, replica, timeout)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				funclog.WithField("replica", replica.Name).Warnf("skipping drain: %s", err.Error())
+				sendMessages([]byte(fmt.Sprintf("Failed to drain %s, removing it anyway \n error: %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, err.Error(), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			}
+			return nil
+		})
+		if err != nil {
+			return models.Fail, err
+		}
+	}
+	for _, replica := range batch {
+		if replica.IPAddress == "" {
+			continue
+		}
+		err = removeReplicaFromDataStoreConfigMap(incident.SqlMasterInstance, replica.IPAddress)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to remove replica from datastore config: %s", err.Error())
+		}
+	}
+	return models.ConfigUpdate, nil
+}
+
+// drainConnections sets the backend OFFLINE_SOFT and polls the connection pool
+// stats until nothing is using it, or the timeout passes.
+func drainConnections(ctx context.Context, incident *models.DataStoreIncident, replica batchReplica, timeout time.Duration) error {
+	ip := replica.IPAddress
+	sendMessages([]byte(fmt.Sprintf("Draining connections from %s for up to %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, timeout, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	err := setProxySQLServerStatus(incident.SqlMasterInstance, ip, "OFFLINE_SOFT")
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		used, err := proxySQLConnectionsUsed(incident.SqlMasterInstance)
+		if err != nil {
+			return err
+		}
+		if used[ip] == 0 {
+			sendMessages([]byte(fmt.Sprintf("Drained connections from %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			sendMessages([]byte(fmt.Sprintf("Drain timed out with %d connections still in use on %s \n IncidentID: %s \n Database: %s \n Project: %s", used[ip], replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			return nil
+		}
+		log.WithField("incident", incident.IncidentID).Debugf("%d connections still in use on %s", used[ip], ip)
+		select {
+		case <-time.After(drainPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
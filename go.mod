@@ -7,6 +7,7 @@ require (
 	cloud.google.com/go/kms v1.1.0
 	cloud.google.com/go/pubsub v1.17.0
 	github.com/eahrend/chestermodels v0.0.0-20211021142845-bad2997247ea
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/google/uuid v1.3.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/slack-go/slack v0.9.5
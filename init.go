@@ -7,6 +7,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 	"k8s.io/client-go/kubernetes"
@@ -16,6 +17,8 @@ import (
 	"k8s.io/client-go/util/homedir"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // initialize sets the configuration from the env vars
@@ -34,6 +37,17 @@ func initialize() error {
 	if projectID == "" {
 		return fmt.Errorf("failed to get project id")
 	}
+	daemonID, err = os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %s", err.Error())
+	}
+	maxConcurrentIncidents = 10
+	if mci := os.Getenv("MAX_CONCURRENT_INCIDENTS"); mci != "" {
+		maxConcurrentIncidents, err = strconv.Atoi(mci)
+		if err != nil || maxConcurrentIncidents < 1 {
+			return fmt.Errorf("invalid MAX_CONCURRENT_INCIDENTS %s", mci)
+		}
+	}
 	pubSubCredFile := os.Getenv("PUBSUB_CREDS")
 	if pubSubCredFile == "" {
 		return fmt.Errorf("failed to get pub sub credential file")
@@ -62,6 +76,23 @@ func initialize() error {
 		return fmt.Errorf("pubsub subscription can not be empty")
 	}
 	subscription = pubSubClient.Subscription(pss)
+	if dlt := os.Getenv("DEAD_LETTER_TOPIC"); dlt != "" {
+		deadLetterTopic = pubSubClient.Topic(dlt)
+	}
+	maxDeliveryAttempts = 5
+	if mda := os.Getenv("MAX_DELIVERY_ATTEMPTS"); mda != "" {
+		maxDeliveryAttempts, err = strconv.Atoi(mda)
+		if err != nil || maxDeliveryAttempts < 1 {
+			return fmt.Errorf("invalid MAX_DELIVERY_ATTEMPTS %s", mda)
+		}
+	}
+	ackMaxExtension = 4 * time.Hour
+	if ame := os.Getenv("ACK_MAX_EXTENSION"); ame != "" {
+		ackMaxExtension, err = time.ParseDuration(ame)
+		if err != nil {
+			return fmt.Errorf("invalid ACK_MAX_EXTENSION %s: %s", ame, err.Error())
+		}
+	}
 	sqlAdminCredFile := os.Getenv("SQLADMIN_CREDS")
 	if sqlAdminCredFile == "" {
 		return fmt.Errorf("failed to find sql admin credential file")
@@ -71,6 +102,54 @@ func initialize() error {
 	if err != nil {
 		return fmt.Errorf("failed to create sqladminsvc with error: %s", err.Error())
 	}
+	sqlAdminCallTimeout = 30 * time.Second
+	if sct := os.Getenv("SQLADMIN_CALL_TIMEOUT"); sct != "" {
+		sqlAdminCallTimeout, err = time.ParseDuration(sct)
+		if err != nil || sqlAdminCallTimeout <= 0 {
+			return fmt.Errorf("invalid SQLADMIN_CALL_TIMEOUT %s", sct)
+		}
+	}
+	sqlAdminMaxRetries = 5
+	if smr := os.Getenv("SQLADMIN_MAX_RETRIES"); smr != "" {
+		sqlAdminMaxRetries, err = strconv.Atoi(smr)
+		if err != nil || sqlAdminMaxRetries < 0 {
+			return fmt.Errorf("invalid SQLADMIN_MAX_RETRIES %s", smr)
+		}
+	}
+	operationWaitTimeout = time.Hour
+	if owt := os.Getenv("OPERATION_WAIT_TIMEOUT"); owt != "" {
+		operationWaitTimeout, err = time.ParseDuration(owt)
+		if err != nil || operationWaitTimeout <= 0 {
+			return fmt.Errorf("invalid OPERATION_WAIT_TIMEOUT %s", owt)
+		}
+	}
+	if omd := os.Getenv("OPERATION_MAX_DURATIONS"); omd != "" {
+		if err := parseOperationMaxDurations(omd); err != nil {
+			return fmt.Errorf("invalid OPERATION_MAX_DURATIONS %s: %s", omd, err.Error())
+		}
+	}
+	operationQueueInterval = 30 * time.Second
+	if oqi := os.Getenv("OPERATION_QUEUE_INTERVAL"); oqi != "" {
+		operationQueueInterval, err = time.ParseDuration(oqi)
+		if err != nil || operationQueueInterval <= 0 {
+			return fmt.Errorf("invalid OPERATION_QUEUE_INTERVAL %s", oqi)
+		}
+	}
+	poolReconcileInterval = 10 * time.Minute
+	if pri := os.Getenv("POOL_RECONCILE_INTERVAL"); pri != "" {
+		poolReconcileInterval, err = time.ParseDuration(pri)
+		if err != nil || poolReconcileInterval <= 0 {
+			return fmt.Errorf("invalid POOL_RECONCILE_INTERVAL %s", pri)
+		}
+	}
+	computeCredFile := os.Getenv("COMPUTE_CREDS")
+	if computeCredFile == "" {
+		computeCredFile = sqlAdminCredFile
+	}
+	computeSvc, err = compute.NewService(ctx, option.WithCredentialsFile(computeCredFile))
+	if err != nil {
+		return fmt.Errorf("failed to create computesvc with error: %s", err.Error())
+	}
 	kmsCredFile := os.Getenv("KMS_CREDS")
 	kmsOpts := option.WithCredentialsFile(kmsCredFile)
 	kmsClient, err = kms.NewKeyManagementClient(ctx, kmsOpts)
@@ -103,6 +182,22 @@ func initialize() error {
 	if err != nil {
 		return fmt.Errorf("failed to create new kuberenetes client from config: %s", err.Error())
 	}
+	proxySQLApplyMode = os.Getenv("PROXYSQL_APPLY_MODE")
+	if proxySQLApplyMode == "" {
+		proxySQLApplyMode = applyModeRestart
+	}
+	if proxySQLApplyMode != applyModeRestart && proxySQLApplyMode != applyModeLive {
+		return fmt.Errorf("invalid PROXYSQL_APPLY_MODE %s, must be %s or %s", proxySQLApplyMode, applyModeRestart, applyModeLive)
+	}
+	leaderElectionEnabled = os.Getenv("LEADER_ELECTION") == "true"
+	leaderElectionNamespace = os.Getenv("LEADER_ELECTION_NAMESPACE")
+	if leaderElectionNamespace == "" {
+		leaderElectionNamespace = "chester"
+	}
+	leaderElectionName = os.Getenv("LEADER_ELECTION_NAME")
+	if leaderElectionName == "" {
+		leaderElectionName = "chester-daemon"
+	}
 
 	return nil
 }
@@ -44,3 +44,27 @@ func getDeployment(labelName, labelValue, namespace string) (v1.Deployment, erro
 	}
 	return v1.Deployment{}, fmt.Errorf("no deployment with label %s and value %s exists", labelName, labelValue)
 }
+
+// getDeploymentPods gets the running pods of a deployment found by label key/value pairs and the namespace
+func getDeploymentPods(labelName, labelValue, namespace string) ([]apiv1.Pod, error) {
+	deploy, err := getDeployment(labelName, labelValue, namespace)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	listOpts := metav1.ListOptions{LabelSelector: selector.String()}
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(context.TODO(), listOpts)
+	if err != nil {
+		return nil, err
+	}
+	var running []apiv1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == apiv1.PodRunning && pod.Status.PodIP != "" {
+			running = append(running, pod)
+		}
+	}
+	return running, nil
+}
@@ -14,7 +14,7 @@ import (
 // on the latest proxysql configuration in datastore
 // TODO: Move this to a secret as it contains sensitive data
 //  in addition we'll add software level encryption to the secrets
-func updateConfigMap(instanceGroup string) error {
+func updateConfigMap(instanceGroup string, startWeights map[string]int64) error {
 	psqlConfig, err := getProxySQLConfig(instanceGroup)
 	if err != nil {
 		return err
@@ -39,6 +39,15 @@ func updateConfigMap(instanceGroup string) error {
 		}
 	}
 	b, err := psqlConfig.ToLibConfig()
+	if err != nil {
+		return err
+	}
+	// the config template has no weight, so add it to each server here
+	weights, err := configMapWeights(instanceGroup, startWeights)
+	if err != nil {
+		return err
+	}
+	b = withServerWeights(b, weights)
 	configMap = apiv1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Configmap",
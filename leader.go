@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElectionEnabled is whether the daemon needs to hold the kubernetes lease before doing any work
+var leaderElectionEnabled bool
+
+// leaderElectionNamespace is the namespace the leader election lease lives in
+var leaderElectionNamespace string
+
+// leaderElectionName is the name of the leader election lease
+var leaderElectionName string
+
+// runAsLeader blocks until this daemon is elected leader, then calls work with
+// a context that is cancelled if leadership is lost. Losing leadership, or work
+// returning an error, exits the process so a standby can take over with a clean slate.
+// If leader election is disabled, work is called straight away.
+func runAsLeader(work func(ctx context.Context) error) error {
+	funclog := log.WithFields(log.Fields{
+		"func":     "runAsLeader",
+		"identity": daemonID,
+	})
+	if !leaderElectionEnabled {
+		funclog.Debugln("leader election disabled, running as the only daemon")
+		return work(ctx)
+	}
+	// RunOrDie retries forever without saying why, so make sure we can read the lease first
+	_, err := kubeClient.CoordinationV1().Leases(leaderElectionNamespace).Get(ctx, leaderElectionName, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get leader election lease %s/%s: %s", leaderElectionNamespace, leaderElectionName, err.Error())
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaderElectionName,
+			Namespace: leaderElectionNamespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: daemonID,
+		},
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				funclog.Infoln("elected leader")
+				err := work(leaderCtx)
+				if err != nil {
+					log.Fatalf("error while leading: %s", err.Error())
+				}
+			},
+			OnStoppedLeading: func() {
+				// anything still in flight was started under our leadership,
+				// exit so we don't keep mutating state alongside the new leader
+				log.Fatalf("lost leadership as %s", daemonID)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != daemonID {
+					funclog.Infof("%s is the current leader, standing by", identity)
+				}
+			},
+		},
+	})
+	return fmt.Errorf("leader election stopped")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	models "github.com/eahrend/chestermodels"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	it "google.golang.org/api/iterator"
+)
+
+// leaseKind is the datastore kind used for instance group leases
+const leaseKind string = "lease"
+
+// leaseDuration is how long a lease is valid for without being renewed
+const leaseDuration = 2 * time.Minute
+
+// leaseRenewInterval is how often the holder of a lease renews it
+const leaseRenewInterval = 30 * time.Second
+
+// leaseAcquireInterval is how often we retry taking a lease that is held by someone else
+const leaseAcquireInterval = 10 * time.Second
+
+// instanceGroupLease is stored in datastore as a child of the proxysql config,
+// so only one incident at a time mutates an instance group.
+type instanceGroupLease struct {
+	// IncidentID is the incident currently holding the lease
+	IncidentID string
+	// Holder is the daemon that is processing the incident
+	Holder string
+	// Token identifies a single acquisition, so two deliveries of the same
+	// incident on the same daemon can't share the lease
+	Token string
+	// ExpiresAt is the unix timestamp after which the lease can be taken over
+	ExpiresAt int64
+}
+
+// generateLeaseKey creates the lease key for an instance group
+func generateLeaseKey(instanceGroup string) *datastore.Key {
+	key := datastore.NameKey(leaseKind, instanceGroup, generateChesterKey(instanceGroup))
+	key.Namespace = "chester"
+	return key
+}
+
+// newLeaseToken creates a token for a single lease acquisition
+func newLeaseToken() string {
+	nonce, _ := uuid.NewRandom()
+	return fmt.Sprintf("%s-%s", daemonID, nonce.String())
+}
+
+// tryAcquireLease attempts to take or renew the lease on an instance group
+// with the given token. It returns false if any other token holds an unexpired
+// lease, even one for the same incident.
+// The incident's InProgress flag is set in the same transaction.
+func tryAcquireLease(instanceGroup, incidentID, token string) (bool, error) {
+	acquired := false
+	_, err := datastoreClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		acquired = false
+		now := time.Now()
+		key := generateLeaseKey(instanceGroup)
+		lease := &instanceGroupLease{}
+		err := tx.Get(key, lease)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && lease.Token != token && lease.ExpiresAt > now.Unix() {
+			log.Debugf("instance group %s is leased to incident %s by %s", instanceGroup, lease.IncidentID, lease.Holder)
+			return nil
+		}
+		lease.IncidentID = incidentID
+		lease.Holder = daemonID
+		lease.Token = token
+		lease.ExpiresAt = now.Add(leaseDuration).Unix()
+		if _, err := tx.Put(key, lease); err != nil {
+			return err
+		}
+		if err := setIncidentInProgress(tx, incidentID, true); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	return acquired, err
+}
+
+// releaseLease gives up the lease on an instance group, if the token still holds it
+func releaseLease(instanceGroup, incidentID, token string) error {
+	_, err := datastoreClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		key := generateLeaseKey(instanceGroup)
+		lease := &instanceGroupLease{}
+		err := tx.Get(key, lease)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if lease.Token != token {
+			return nil
+		}
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+		return setIncidentInProgress(tx, incidentID, false)
+	})
+	return err
+}
+
+// setIncidentInProgress flags the incident as being worked on. Incidents
+// that are not stored in datastore (like restarts) or that have already
+// been cleared are skipped.
+func setIncidentInProgress(tx *datastore.Transaction, incidentID string, inProgress bool) error {
+	if incidentID == "" {
+		return nil
+	}
+	dsi := &models.DataStoreIncident{}
+	key := datastore.NameKey("incident", incidentID, nil)
+	key.Namespace = "chester"
+	err := tx.Get(key, dsi)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dsi.InProgress = inProgress
+	dsi.LastUpdated = time.Now().UTC().Format(time.RFC3339)
+	dsi.LastUpdatedBy = "daemon"
+	_, err = tx.Put(key, dsi)
+	return err
+}
+
+// holdLease blocks until the incident holds the lease for the instance group.
+// The returned context is cancelled if the lease is lost, and the returned
+// function stops renewing and releases the lease.
+func holdLease(parent context.Context, instanceGroup, incidentID string) (context.Context, func(), error) {
+	funclog := log.WithFields(log.Fields{
+		"func":          "holdLease",
+		"incident":      incidentID,
+		"instanceGroup": instanceGroup,
+	})
+	token := newLeaseToken()
+	for {
+		acquired, err := tryAcquireLease(instanceGroup, incidentID, token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to acquire lease on %s: %s", instanceGroup, err.Error())
+		}
+		if acquired {
+			break
+		}
+		funclog.Debugf("waiting on lease")
+		select {
+		case <-time.After(leaseAcquireInterval):
+		case <-parent.Done():
+			return nil, nil, parent.Err()
+		}
+	}
+	funclog.Debugf("acquired lease")
+	leaseCtx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(leaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-leaseCtx.Done():
+				return
+			case <-ticker.C:
+				held, err := tryAcquireLease(instanceGroup, incidentID, token)
+				if err != nil {
+					funclog.Warnf("failed to renew lease: %s", err.Error())
+					continue
+				}
+				if !held {
+					funclog.Errorf("lost lease, stopping incident processing")
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	release := func() {
+		close(done)
+		cancel()
+		if err := releaseLease(instanceGroup, incidentID, token); err != nil {
+			funclog.Errorf("failed to release lease: %s", err.Error())
+		}
+	}
+	return leaseCtx, release, nil
+}
+
+// clearStaleLeases removes leases held by other daemons. This is only called
+// by the leader during startup, at which point any other holder is either
+// dead or has exited after losing leadership, so its incidents can be resumed
+// straight away instead of waiting for the leases to expire.
+func clearStaleLeases() error {
+	q := datastore.NewQuery(leaseKind).Namespace("chester")
+	iter := datastoreClient.Run(ctx, q)
+	for {
+		lease := instanceGroupLease{}
+		key, err := iter.Next(&lease)
+		if err == it.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if lease.Holder == daemonID {
+			continue
+		}
+		log.Debugf("clearing lease on %s held by %s for incident %s", key.Name, lease.Holder, lease.IncidentID)
+		if err := releaseLease(key.Name, lease.IncidentID, lease.Token); err != nil {
+			return err
+		}
+	}
+}
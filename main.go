@@ -5,7 +5,9 @@ import (
 	kms "cloud.google.com/go/kms/apiv1"
 	"cloud.google.com/go/pubsub"
 	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	compute "google.golang.org/api/compute/v1"
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 	"k8s.io/client-go/kubernetes"
 )
@@ -25,6 +27,9 @@ var kubeClient *kubernetes.Clientset
 // sqlAdminSvc is the sql admin api client used between different functions in the runtime
 var sqlAdminSvc *sqladmin.Service
 
+// computeSvc is the compute api client, used to look up the zones in a region
+var computeSvc *compute.Service
+
 // datastoreClient is the datastore client used between different functions in the runtime
 var datastoreClient *datastore.Client
 
@@ -43,6 +48,12 @@ var topic *pubsub.Topic
 // subscription is the name of the pubsub subscription that we'll listen to
 var subscription *pubsub.Subscription
 
+// daemonID identifies this instance of the daemon, it defaults to the hostname which is the pod name in k8s
+var daemonID string
+
+// maxConcurrentIncidents is the number of incidents processed at the same time
+var maxConcurrentIncidents int
+
 // entrypoint, duh.
 func main() {
 	// TODO: set this to be configurable
@@ -51,12 +62,17 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed during initialization: %s", err.Error())
 	}
-	// do some initial scanning to ensure we're not stepping on toes
-	err = startup()
-	if err != nil {
-		log.Fatalf("failed during initial datastore sweep: %s", err.Error())
-	}
-	// run starts the actual application
-	err = run()
+	// only the leader sweeps datastore and consumes the subscription
+	err = runAsLeader(func(leaderCtx context.Context) error {
+		// do some initial scanning to ensure we're not stepping on toes
+		err := startup()
+		if err != nil {
+			return fmt.Errorf("failed during initial datastore sweep: %s", err.Error())
+		}
+		// keep the warm pools topped up between incidents
+		go reconcilePools(leaderCtx)
+		// run starts the actual application
+		return run(leaderCtx)
+	})
 	log.Fatalf("error from runner: %s", err.Error())
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+// openReplica opens a connection to a replica with the proxysql monitor user,
+// which already needs access to every backend to check their health.
+func openReplica(ipAddress string, psqlConfig *models.ProxySqlConfig) (*sql.DB, error) {
+	user := psqlConfig.MysqlVariables.MonitorUsername
+	if user == "" {
+		return nil, fmt.Errorf("no monitor user in proxysql config")
+	}
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:3306)/?timeout=10s", user, psqlConfig.MysqlVariables.MonitorPassword, ipAddress)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// replicationLag returns Seconds_Behind_Master for a replica. It returns an
+// error if replication isn't running, since the lag is unknown.
+func replicationLag(ipAddress string, psqlConfig *models.ProxySqlConfig) (int64, error) {
+	db, err := openReplica(ipAddress, psqlConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s is not replicating", ipAddress)
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, fmt.Errorf("replication on %s is stopped", ipAddress)
+		}
+		var lag int64
+		_, err := fmt.Sscan(values[i].String, &lag)
+		return lag, err
+	}
+	return 0, fmt.Errorf("no Seconds_Behind_Master from %s", ipAddress)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// operationPollInterval is how often waitForOperation polls an operation
+const operationPollInterval = 5 * time.Second
+
+// operationProgressInterval is how often waitForOperation records progress on
+// the incident and checks the incident is still current
+const operationProgressInterval = 30 * time.Second
+
+// operationWaitTimeout is the max duration of operation types that aren't in operationMaxDurations
+var operationWaitTimeout time.Duration
+
+// operationMaxDurations is how long an operation of each type may run before
+// waiting on it fails. Types that aren't listed get operationWaitTimeout.
+// OPERATION_MAX_DURATIONS overrides these.
+var operationMaxDurations = map[string]time.Duration{
+	"CREATE_REPLICA": 90 * time.Minute,
+	"DELETE":         30 * time.Minute,
+	"UPDATE":         30 * time.Minute,
+	"RESTART":        15 * time.Minute,
+}
+
+// errIncidentClosed means the incident was closed while the daemon was waiting on it
+var errIncidentClosed = errors.New("incident was closed")
+
+// errIncidentSuperseded means the incident was deleted or moved on by someone
+// else while the daemon was waiting on it
+var errIncidentSuperseded = errors.New("incident was superseded")
+
+// parseOperationMaxDurations parses a list like CREATE_REPLICA=90m,DELETE=30m
+// into operationMaxDurations
+func parseOperationMaxDurations(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expected OPERATION_TYPE=duration, got %s", pair)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration for %s: %s", parts[0], parts[1])
+		}
+		operationMaxDurations[strings.ToUpper(parts[0])] = d
+	}
+	return nil
+}
+
+// operationMaxDuration returns how long an operation of operationType may run
+func operationMaxDuration(operationType string) time.Duration {
+	if d, ok := operationMaxDurations[operationType]; ok {
+		return d
+	}
+	return operationWaitTimeout
+}
+
+// operationStarted returns when an operation was queued by cloud sql, falling
+// back to now if the api didn't say
+func operationStarted(op *sqladmin.Operation) time.Time {
+	started, err := time.Parse(time.RFC3339, op.InsertTime)
+	if err != nil {
+		return time.Now()
+	}
+	return started
+}
+
+// checkIncidentCurrent returns errIncidentClosed if the incident in ctx has
+// been closed and isn't already being wound down, or errIncidentSuperseded if it's gone or no longer on the step
+// that ctx was made for. Both are permanent, retrying the step won't help.
+func checkIncidentCurrent(ctx context.Context) error {
+	ref := incidentFromContext(ctx)
+	if ref.ID == "" {
+		return nil
+	}
+	incident, err := getIncident(ref.ID)
+	if err == datastore.ErrNoSuchEntity {
+		return permanent(fmt.Errorf("incident %s no longer exists: %w", ref.ID, errIncidentSuperseded))
+	}
+	if err != nil {
+		// not being able to check isn't a reason to stop waiting
+		log.WithField("incident", ref.ID).Warnf("failed to check incident state: %s", err.Error())
+		return nil
+	}
+	if incident.State == models.Closed && !ref.Closing {
+		return permanent(fmt.Errorf("incident %s: %w", ref.ID, errIncidentClosed))
+	}
+	if ref.Process != "" && incident.LastProcess != ref.Process {
+		return permanent(fmt.Errorf("incident %s moved from %s to %s: %w", ref.ID, ref.Process, incident.LastProcess, errIncidentSuperseded))
+	}
+	return nil
+}
+
+// recordOperationProgress stores how far along an operation is on the incident in ctx
+func recordOperationProgress(ctx context.Context, op *sqladmin.Operation, elapsed, max time.Duration) {
+	ref := incidentFromContext(ctx)
+	if ref.ID == "" {
+		return
+	}
+	_, err := updateIncidentDetails(ref.ID, func(details *incidentDetails) {
+		details.OperationProgress = fmt.Sprintf("%s operation %s on %s is %s after %s of %s", op.OperationType, op.Name, op.TargetId, op.Status, elapsed.Round(time.Second), max)
+	})
+	if err != nil {
+		log.WithField("incident", ref.ID).Warnf("failed to record operation progress: %s", err.Error())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOperationMaxDurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{name: "single", value: "CREATE_REPLICA=2h", want: map[string]time.Duration{"CREATE_REPLICA": 2 * time.Hour}},
+		{name: "list with spaces", value: "DELETE=10m, restart=5m", want: map[string]time.Duration{"DELETE": 10 * time.Minute, "RESTART": 5 * time.Minute}},
+		{name: "missing duration", value: "DELETE", wantErr: true},
+		{name: "missing type", value: "=10m", wantErr: true},
+		{name: "bad duration", value: "DELETE=soon", wantErr: true},
+		{name: "zero duration", value: "DELETE=0s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := operationMaxDurations
+			defer func() { operationMaxDurations = saved }()
+			operationMaxDurations = map[string]time.Duration{}
+			err := parseOperationMaxDurations(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(operationMaxDurations) != len(tt.want) {
+				t.Errorf("got %v, want %v", operationMaxDurations, tt.want)
+			}
+			for op, d := range tt.want {
+				if operationMaxDurations[op] != d {
+					t.Errorf("%s: got %s, want %s", op, operationMaxDurations[op], d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// operationQueueInterval is how long a queued operation waits between checks
+// on the master's pending operations
+var operationQueueInterval time.Duration
+
+// errOperationSkipped is returned by a submit function that found, once it was
+// its turn, that the operation is no longer needed
+var errOperationSkipped = errors.New("operation no longer needed")
+
+// masterQueues holds one queue per master instance, mutating sqladmin calls
+// against a master's replicas are submitted one at a time through it
+var masterQueues = map[string]chan struct{}{}
+
+// masterQueuesMu guards masterQueues
+var masterQueuesMu sync.Mutex
+
+// masterQueue returns the queue for a master instance, creating it if needed.
+// The queue is a channel with room for one, holding the slot is holding the queue.
+func masterQueue(master string) chan struct{} {
+	masterQueuesMu.Lock()
+	defer masterQueuesMu.Unlock()
+	queue, ok := masterQueues[master]
+	if !ok {
+		queue = make(chan struct{}, 1)
+		masterQueues[master] = queue
+	}
+	return queue
+}
+
+// isConflict checks whether an error from the sqladmin api is a 409, which
+// cloud sql returns when another operation is running on the instance
+func isConflict(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusConflict
+}
+
+// masterName returns the name of a replica's master instance. The api formats
+// masterInstanceName as project:instance.
+func masterName(instance *sqladmin.DatabaseInstance) string {
+	master := instance.MasterInstanceName
+	if i := strings.LastIndex(master, ":"); i >= 0 {
+		master = master[i+1:]
+	}
+	return master
+}
+
+// pendingOperation returns the first operation on an instance that is pending
+// or running, or nil if the instance is idle. A missing instance is idle.
+func pendingOperation(ctx context.Context, instanceName string) (*sqladmin.Operation, error) {
+	var resp *sqladmin.OperationsListResponse
+	err := callSQLAdmin(ctx, "operations.list", func(ctx context.Context) error {
+		var err error
+		resp, err = sqlAdminSvc.Operations.List(projectID).Instance(instanceName).Context(ctx).Do()
+		return err
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range resp.Items {
+		if op.Status == "PENDING" || op.Status == "RUNNING" {
+			return op, nil
+		}
+	}
+	return nil, nil
+}
+
+// scheduleOperation submits a mutating sqladmin call against master once it is
+// this caller's turn in the master's queue and none of the instances have an
+// operation pending or running. If cloud sql still answers 409 the call goes
+// back to waiting instead of failing. It gives up when ctx is done. Submit
+// runs with the queue held, so it can check the instances again before acting
+// and return errOperationSkipped if there's nothing left to do.
+func scheduleOperation(ctx context.Context, master string, instances []string, description string, submit func() (*sqladmin.Operation, error)) (*sqladmin.Operation, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":   "scheduleOperation",
+		"master": master,
+	})
+	queue := masterQueue(master)
+	select {
+	case queue <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("stopped waiting to %s, queue for %s is busy: %s", description, master, ctx.Err())
+	}
+	defer func() { <-queue }()
+	for {
+		busy, err := firstPendingOperation(ctx, instances)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check pending operations on %s: %s", master, err.Error())
+		}
+		if busy == nil {
+			op, err := submit()
+			if err == nil {
+				if op == nil {
+					return nil, fmt.Errorf("no operation returned to %s", description)
+				}
+				return op, nil
+			}
+			if !isConflict(err) {
+				return nil, err
+			}
+			funclog.Infof("%s got a conflict, queueing: %s", description, err.Error())
+		} else {
+			funclog.Infof("%s is queued behind %s operation %s on %s", description, busy.OperationType, busy.Name, busy.TargetId)
+		}
+		select {
+		case <-time.After(operationQueueInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped waiting to %s: %s", description, ctx.Err())
+		}
+	}
+}
+
+// firstPendingOperation returns the first pending or running operation on any
+// of the instances
+func firstPendingOperation(ctx context.Context, instances []string) (*sqladmin.Operation, error) {
+	for _, instance := range instances {
+		op, err := pendingOperation(ctx, instance)
+		if err != nil || op != nil {
+			return op, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// removeDelete deletes replicas on scale down
+	removeDelete string = "delete"
+	// removePark stops replicas on scale down and keeps them to start again on a scale up
+	removePark string = "park"
+)
+
+// poolParked marks a replica stopped on a scale down to be started again on a scale up
+const poolParked string = "parked"
+
+// parkedAtLabel is the user label holding when a replica was parked, in unix seconds
+const parkedAtLabel string = "chester_parked_at"
+
+// parkedAt returns when a replica was parked, or the zero time if it isn't parked
+func parkedAt(instance *sqladmin.DatabaseInstance) time.Time {
+	if instance.Settings == nil {
+		return time.Time{}
+	}
+	seconds, err := strconv.ParseInt(instance.Settings.UserLabels[parkedAtLabel], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// parkedExpired checks whether a replica is still parked, past retention and not already being deleted
+func parkedExpired(replica *sqladmin.DatabaseInstance, retention time.Duration) bool {
+	return poolState(replica) == poolParked && replica.State != "PENDING_DELETE" && time.Since(parkedAt(replica)) >= retention
+}
+
+// removeBatch returns a step that parks or deletes every replica in the
+// batch, depending on the group's scale down policy, then moves on to next.
+func removeBatch(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		policy, err := getScaleDownPolicy(incident.SqlMasterInstance)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to get scale down policy: %s", err.Error())
+		}
+		switch policy.RemoveMode {
+		case removePark:
+			return parkReplica(next)(ctx, incident)
+		case removeDelete:
+			return deleteReplica(next)(ctx, incident)
+		}
+		return models.Fail, permanent(fmt.Errorf("unknown remove mode %s", policy.RemoveMode))
+	}
+}
+
+// parkReplica returns a step that stops every replica in the batch and marks
+// it as parked, then moves on to next. Parked replicas past the group's
+// retention are deleted in the background.
+func parkReplica(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		batch, err := getBatch(incident)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+		}
+		err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+			return returnToPool(ctx, incident, replica, poolParked)
+		})
+		if err != nil {
+			return models.Fail, err
+		}
+		expireParkedReplicas(*incident)
+		return next, nil
+	}
+}
+
+// returnToPool stops a replica of the batch, marks it as in pool and stores
+// the operation on it. Replicas that are already gone or in the pool aren't
+// patched again.
+func returnToPool(ctx context.Context, incident *models.DataStoreIncident, replica batchReplica, pool string) error {
+	existing, err := findInstance(ctx, replica.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up replica %s: %s", replica.Name, err.Error())
+	}
+	if existing == nil {
+		log.WithField("incident", incident.IncidentID).Infof("replica %s is already deleted", replica.Name)
+		return nil
+	}
+	operationID := replica.OperationID
+	if operationID == "" && poolState(existing) == pool {
+		operationID, err = findOperation(ctx, replica.Name, "UPDATE")
+		if err != nil {
+			return fmt.Errorf("failed to find %s operation: %s", pool, err.Error())
+		}
+	}
+	if operationID == "" && poolState(existing) != pool {
+		stoppedAt := ""
+		if pool == poolParked {
+			stoppedAt = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		op, err := patchReplicaPool(ctx, masterName(existing), existing, "NEVER", pool, stoppedAt)
+		if err != nil {
+			return err
+		}
+		operationID = op.Name
+		sendMessages([]byte(fmt.Sprintf("Returning instance %s to the %s pool operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, pool, operationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	}
+	return updateBatchReplica(incident.IncidentID, replica.Name, func(replica *batchReplica) {
+		replica.OperationID = operationID
+	})
+}
+
+// expireParkedReplicas deletes the instance group's parked replicas that have
+// been parked longer than the group's retention, in the background.
+func expireParkedReplicas(incident models.DataStoreIncident) {
+	runInBackground("expire parked replicas", incident.SqlMasterInstance, incident.IncidentID, func(ctx context.Context) error {
+		return deleteExpiredReplicas(ctx, incident)
+	})
+}
+
+// deleteExpiredReplicas deletes parked replicas past the group's retention.
+// It doesn't wait on the deletes. Each replica is looked up again once its
+// delete is at the front of the master's queue, so one a scale up started
+// while the delete was queued is left alone.
+func deleteExpiredReplicas(ctx context.Context, incident models.DataStoreIncident) error {
+	policy, err := getScaleDownPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return fmt.Errorf("failed to get scale down policy: %s", err.Error())
+	}
+	parked, err := getPoolReplicas(ctx, incident.SqlMasterInstance, poolParked)
+	if err != nil {
+		return fmt.Errorf("failed to list parked replicas: %s", err.Error())
+	}
+	retention := time.Duration(policy.ParkRetentionSeconds) * time.Second
+	for _, replica := range parked {
+		if !parkedExpired(replica, retention) {
+			continue
+		}
+		master, name := masterName(replica), replica.Name
+		op, err := scheduleOperation(ctx, master, []string{master, name}, fmt.Sprintf("delete parked replica %s", name), func() (*sqladmin.Operation, error) {
+			current, err := findInstance(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if current == nil || !parkedExpired(current, retention) {
+				return nil, errOperationSkipped
+			}
+			return deleteInstance(ctx, name)
+		})
+		if errors.Is(err, errOperationSkipped) {
+			log.WithField("instanceGroup", incident.SqlMasterInstance).Infof("parked replica %s is no longer expired, leaving it", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete parked replica %s: %s", name, err.Error())
+		}
+		sendMessages([]byte(fmt.Sprintf("Destroying instance %s, parked since %s, operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, parkedAt(replica).UTC().Format(time.RFC3339), op.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	}
+	return nil
+}
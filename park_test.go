@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+func TestParkedExpired(t *testing.T) {
+	replica := func(state, pool string, parked time.Time) *sqladmin.DatabaseInstance {
+		return &sqladmin.DatabaseInstance{
+			State: state,
+			Settings: &sqladmin.Settings{UserLabels: map[string]string{
+				poolLabel:     pool,
+				parkedAtLabel: strconv.FormatInt(parked.Unix(), 10),
+			}},
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name    string
+		replica *sqladmin.DatabaseInstance
+		want    bool
+	}{
+		{name: "parked past retention", replica: replica("RUNNABLE", poolParked, old), want: true},
+		{name: "parked within retention", replica: replica("RUNNABLE", poolParked, time.Now()), want: false},
+		{name: "started by a scale up", replica: replica("RUNNABLE", "", old), want: false},
+		{name: "warm", replica: replica("RUNNABLE", poolWarm, old), want: false},
+		{name: "already being deleted", replica: replica("PENDING_DELETE", poolParked, old), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parkedExpired(tt.replica, time.Hour); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	compute "google.golang.org/api/compute/v1"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// placementSpread creates new replicas in the zone with the fewest of the group's replicas
+	placementSpread string = "spread"
+	// placementAny lets cloud sql pick the zone
+	placementAny string = "any"
+)
+
+// replicaZone returns the zone a replica is running in, or the zone it asked for
+func replicaZone(replica *sqladmin.DatabaseInstance) string {
+	if replica.GceZone != "" {
+		return replica.GceZone
+	}
+	if replica.Settings != nil && replica.Settings.LocationPreference != nil {
+		return replica.Settings.LocationPreference.Zone
+	}
+	return ""
+}
+
+// regionZones returns the zones in a region that are up
+func regionZones(region string) ([]string, error) {
+	zones := []string{}
+	err := computeSvc.Zones.List(projectID).Pages(ctx, func(resp *compute.ZoneList) error {
+		for _, zone := range resp.Items {
+			if zone.Status == "UP" && path.Base(zone.Region) == region {
+				zones = append(zones, zone.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// pickZone picks the zone with the fewest of the instance group's replicas,
+// out of the given zones in the region, or every zone in the region if none are given.
+// If the region's zones can't be looked up, it returns no zone, so cloud
+// sql picks one.
+func pickZone(instanceGroup, region string, zones []string, replicas []*sqladmin.DatabaseInstance) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":          "pickZone",
+		"instanceGroup": instanceGroup,
+	})
+	// the template's zones only apply to the region they're in
+	inRegion := []string{}
+	for _, zone := range zones {
+		if strings.HasPrefix(zone, region+"-") {
+			inRegion = append(inRegion, zone)
+		}
+	}
+	zones = inRegion
+	if len(zones) == 0 {
+		var err error
+		zones, err = regionZones(region)
+		if err != nil {
+			funclog.Warnf("failed to list zones in %s, letting cloud sql pick: %s", region, err.Error())
+			return "", nil
+		}
+	}
+	if len(zones) == 0 {
+		return "", nil
+	}
+	count := map[string]int{}
+	for _, replica := range replicas {
+		count[replicaZone(replica)]++
+	}
+	zone := zones[0]
+	for _, z := range zones[1:] {
+		if count[z] < count[zone] {
+			zone = z
+		}
+	}
+	funclog.Debugf("picked %s, which has %d replicas", zone, count[zone])
+	return zone, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	models "github.com/eahrend/chestermodels"
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// proxySQLAdminPort is the port of the proxysql admin interface
+const proxySQLAdminPort = 6032
+
+// apply modes for proxysql config changes
+const (
+	// applyModeRestart does a rolling restart of the proxysql deployment
+	applyModeRestart = "restart"
+	// applyModeLive applies the server changes through the admin interface of each pod
+	applyModeLive = "live"
+)
+
+// proxySQLApplyMode is how config changes reach the running proxysql pods
+var proxySQLApplyMode string
+
+// proxySQLAdminCredentials picks the credentials the daemon uses for the admin
+// interface from admin_credentials, formatted as user:pass;user:pass. The
+// default admin user can only log in from localhost, so another user is
+// preferred when there is one.
+func proxySQLAdminCredentials(psqlConfig *models.ProxySqlConfig) (string, string, error) {
+	var user, pass string
+	for _, credential := range strings.Split(psqlConfig.AdminVariables.AdminCredentials, ";") {
+		parts := strings.SplitN(strings.TrimSpace(credential), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if user == "" || user == "admin" {
+			user, pass = parts[0], parts[1]
+		}
+	}
+	if user == "" {
+		return "", "", fmt.Errorf("no admin credentials in proxysql config")
+	}
+	return user, pass, nil
+}
+
+// openProxySQLAdmin opens a connection to the admin interface of a proxysql pod.
+// The admin interface doesn't support prepared statements, so parameters are
+// interpolated by the driver.
+func openProxySQLAdmin(podIP, user, pass string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/?interpolateParams=true&timeout=10s", user, pass, podIP, proxySQLAdminPort)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// forEachProxySQLAdmin runs fn against the admin interface of every running
+// proxysql pod for the instance group.
+func forEachProxySQLAdmin(instanceGroup string, fn func(podName string, db *sql.DB) error) error {
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return err
+	}
+	user, pass, err := proxySQLAdminCredentials(psqlConfig)
+	if err != nil {
+		return err
+	}
+	pods, err := getDeploymentPods("instancegroup", instanceGroup, "proxysql")
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no running proxysql pods for %s", instanceGroup)
+	}
+	for _, pod := range pods {
+		db, err := openProxySQLAdmin(pod.Status.PodIP, user, pass)
+		if err != nil {
+			return fmt.Errorf("failed to connect to proxysql pod %s: %s", pod.Name, err.Error())
+		}
+		err = fn(pod.Name, db)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("proxysql pod %s: %s", pod.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// proxySQLConnectionsUsed returns the number of connections in use to each
+// backend, summed across every proxysql pod for the instance group.
+func proxySQLConnectionsUsed(instanceGroup string) (map[string]int64, error) {
+	used := map[string]int64{}
+	err := forEachProxySQLAdmin(instanceGroup, func(podName string, db *sql.DB) error {
+		rows, err := db.Query("SELECT srv_host, ConnUsed FROM stats_mysql_connection_pool")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var host string
+			var connUsed int64
+			if err := rows.Scan(&host, &connUsed); err != nil {
+				return err
+			}
+			used[host] += connUsed
+		}
+		log.Debugf("read connection pool stats from %s", podName)
+		return rows.Err()
+	})
+	return used, err
+}
+
+// setProxySQLServerStatus sets the status of a backend on every proxysql pod
+// for the instance group and loads it to runtime.
+func setProxySQLServerStatus(instanceGroup, ipAddress, status string) error {
+	return forEachProxySQLAdmin(instanceGroup, func(podName string, db *sql.DB) error {
+		if _, err := db.Exec("UPDATE mysql_servers SET status = ? WHERE hostname = ?", status, ipAddress); err != nil {
+			return err
+		}
+		if _, err := db.Exec("LOAD MYSQL SERVERS TO RUNTIME"); err != nil {
+			return err
+		}
+		log.Debugf("set %s to %s on %s", ipAddress, status, podName)
+		return nil
+	})
+}
+
+// proxySQLServerKey identifies a row in mysql_servers
+type proxySQLServerKey struct {
+	hostgroup int
+	hostname  string
+	port      int64
+}
+
+// applyProxySQLServers brings mysql_servers on every proxysql pod for the
+// instance group in line with the proxysql config in datastore, with
+// replicas weighted by their tier, then loads it to runtime and saves it to disk. Rows are only touched if they differ,
+// so running it again is harmless.
+func applyProxySQLServers(instanceGroup string) error {
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return err
+	}
+	weights, err := backendWeights(instanceGroup)
+	if err != nil {
+		return err
+	}
+	scaleUp, err := getScaleUpPolicy(instanceGroup)
+	if err != nil {
+		return err
+	}
+	want := map[proxySQLServerKey]models.ProxySqlMySqlServer{}
+	for _, server := range psqlConfig.MySqlServers {
+		want[proxySQLServerKey{server.Hostgroup, server.Address, server.Port}] = server
+	}
+	// wantWeight is the weight a replica should have, zero leaves it alone
+	wantWeight := func(server models.ProxySqlMySqlServer) int64 {
+		return weights[server.Address]
+	}
+	return forEachProxySQLAdmin(instanceGroup, func(podName string, db *sql.DB) error {
+		have := map[proxySQLServerKey]models.ProxySqlMySqlServer{}
+		haveWeight := map[proxySQLServerKey]int64{}
+		rows, err := db.Query("SELECT hostgroup_id, hostname, port, max_connections, comment, use_ssl, weight FROM mysql_servers")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			server := models.ProxySqlMySqlServer{}
+			var weight int64
+			if err := rows.Scan(&server.Hostgroup, &server.Address, &server.Port, &server.MaxConnections, &server.Comment, &server.UseSSL, &weight); err != nil {
+				rows.Close()
+				return err
+			}
+			key := proxySQLServerKey{server.Hostgroup, server.Address, server.Port}
+			have[key] = server
+			haveWeight[key] = weight
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for key := range have {
+			if _, ok := want[key]; ok {
+				continue
+			}
+			log.Debugf("removing %s:%d from hostgroup %d on %s", key.hostname, key.port, key.hostgroup, podName)
+			_, err := db.Exec("DELETE FROM mysql_servers WHERE hostgroup_id = ? AND hostname = ? AND port = ?", key.hostgroup, key.hostname, key.port)
+			if err != nil {
+				return err
+			}
+		}
+		for key, server := range want {
+			weight := wantWeight(server)
+			current, ok := have[key]
+			if !ok {
+				// new replicas join at the start of the ramp, which raises them from there
+				if weight > 0 && scaleUp.RampEnabled && scaleUp.RampStartWeight > 0 && scaleUp.RampStartWeight < weight {
+					weight = scaleUp.RampStartWeight
+				}
+				if weight == 0 {
+					weight = 1
+				}
+				log.Debugf("adding %s:%d to hostgroup %d with weight %d on %s", key.hostname, key.port, key.hostgroup, weight, podName)
+				_, err := db.Exec("INSERT INTO mysql_servers (hostgroup_id, hostname, port, max_connections, comment, use_ssl, weight) VALUES (?, ?, ?, ?, ?, ?, ?)",
+					server.Hostgroup, server.Address, server.Port, server.MaxConnections, server.Comment, server.UseSSL, weight)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if weight > 0 && haveWeight[key] != weight {
+				_, err := db.Exec("UPDATE mysql_servers SET weight = ? WHERE hostgroup_id = ? AND hostname = ? AND port = ?", weight, key.hostgroup, key.hostname, key.port)
+				if err != nil {
+					return err
+				}
+			}
+			if current.MaxConnections == server.MaxConnections && current.Comment == server.Comment && current.UseSSL == server.UseSSL {
+				continue
+			}
+			_, err := db.Exec("UPDATE mysql_servers SET max_connections = ?, comment = ?, use_ssl = ? WHERE hostgroup_id = ? AND hostname = ? AND port = ?",
+				server.MaxConnections, server.Comment, server.UseSSL, key.hostgroup, key.hostname, key.port)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := db.Exec("LOAD MYSQL SERVERS TO RUNTIME"); err != nil {
+			return err
+		}
+		if _, err := db.Exec("SAVE MYSQL SERVERS TO DISK"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// applyProxySQLConfig gets the proxysql config in datastore onto the running
+// proxysql pods, using the configured apply mode. The configmap is expected to
+// be up to date already, so new pods start with the same servers. If a live
+// apply fails, a rolling restart is done instead so no pod is left behind.
+func applyProxySQLConfig(instanceGroup string) error {
+	if proxySQLApplyMode != applyModeLive {
+		return reloadProxySql(instanceGroup)
+	}
+	err := applyProxySQLServers(instanceGroup)
+	if err == nil {
+		return nil
+	}
+	log.WithField("instanceGroup", instanceGroup).Warnf("live apply failed, falling back to a rolling restart: %s", err.Error())
+	sendMessages([]byte(fmt.Sprintf("Failed to apply proxysql config live, doing a rolling restart \n error: %s \n Database: %s \n Project: %s", err.Error(), instanceGroup, projectID)))
+	return reloadProxySql(instanceGroup)
+}
+
+// proxySQLServerStat is a backend's connection pool stats summed across every proxysql pod
+type proxySQLServerStat struct {
+	// ConnOK is the number of connections established successfully
+	ConnOK int64
+	// ConnErr is the number of connections that failed to establish
+	ConnErr int64
+	// Shunned is whether any proxysql pod has shunned the backend
+	Shunned bool
+}
+
+// proxySQLServerStats reads the connection pool stats for a backend from
+// every proxysql pod for the instance group.
+func proxySQLServerStats(instanceGroup, ipAddress string) (proxySQLServerStat, error) {
+	stat := proxySQLServerStat{}
+	err := forEachProxySQLAdmin(instanceGroup, func(podName string, db *sql.DB) error {
+		rows, err := db.Query("SELECT status, ConnOK, ConnERR FROM stats_mysql_connection_pool WHERE srv_host = ?", ipAddress)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var status string
+			var connOK, connErr int64
+			if err := rows.Scan(&status, &connOK, &connErr); err != nil {
+				return err
+			}
+			stat.ConnOK += connOK
+			stat.ConnErr += connErr
+			if status == "SHUNNED" {
+				stat.Shunned = true
+			}
+		}
+		return rows.Err()
+	})
+	return stat, err
+}
+
+// setProxySQLServerWeights sets the weight of each backend on every proxysql
+// pod for the instance group, then loads it to runtime. Backends without a
+// weight are left alone.
+func setProxySQLServerWeights(instanceGroup string, weights map[string]int64) error {
+	return forEachProxySQLAdmin(instanceGroup, func(podName string, db *sql.DB) error {
+		for ipAddress, weight := range weights {
+			if _, err := db.Exec("UPDATE mysql_servers SET weight = ? WHERE hostname = ?", weight, ipAddress); err != nil {
+				return err
+			}
+		}
+		if _, err := db.Exec("LOAD MYSQL SERVERS TO RUNTIME"); err != nil {
+			return err
+		}
+		log.Debugf("set weights on %s", podName)
+		return nil
+	})
+}
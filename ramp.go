@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaRamp means the new replica is in proxysql and its weight is being raised
+const replicaRamp string = "replica_ramp"
+
+// rampPollInterval is how often a ramping replica's health is checked
+const rampPollInterval = 15 * time.Second
+
+// rampMinConnections is the number of new connections needed before the error
+// rate of a ramping replica is taken into account, so a single failed
+// connection on a quiet group doesn't abort the ramp
+const rampMinConnections int64 = 20
+
+// rampWeight returns a replica's weight at a step of a ramp, going from start
+// at the first step up to full at the last
+func rampWeight(step, steps int, start, full int64) int64 {
+	if steps < 2 || start >= full || step >= steps-1 {
+		return full
+	}
+	if start < 1 {
+		start = 1
+	}
+	return start + (full-start)*int64(step)/int64(steps-1)
+}
+
+// checkRampHealth returns an error if the ramping replica is shunned by proxysql,
+// its connection error rate since the step started is over the limit, or it
+// has fallen too far behind the master.
+func checkRampHealth(instanceGroup, ipAddress string, policy scaleUpPolicy, baseline proxySQLServerStat) error {
+	stats, err := proxySQLServerStats(instanceGroup, ipAddress)
+	if err != nil {
+		return err
+	}
+	if stats.Shunned {
+		return permanent(fmt.Errorf("proxysql shunned %s", ipAddress))
+	}
+	connOK := stats.ConnOK - baseline.ConnOK
+	connErr := stats.ConnErr - baseline.ConnErr
+	if connOK+connErr >= rampMinConnections {
+		rate := float64(connErr) / float64(connOK+connErr)
+		if rate > policy.RampMaxErrorRate {
+			return permanent(fmt.Errorf("connection error rate on %s is %.2f, more than %.2f", ipAddress, rate, policy.RampMaxErrorRate))
+		}
+	}
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return err
+	}
+	lag, err := replicationLag(ipAddress, psqlConfig)
+	if err != nil {
+		return err
+	}
+	if lag > policy.MaxReplicationLagSeconds {
+		return permanent(fmt.Errorf("replication lag on %s is %ds, more than %ds", ipAddress, lag, policy.MaxReplicationLagSeconds))
+	}
+	return nil
+}
+
+// rampStartWeights returns the weight the batch's replicas join proxysql with,
+// keyed by IP, or nil if the group doesn't ramp new replicas
+func rampStartWeights(incident *models.DataStoreIncident) (map[string]int64, error) {
+	policy, err := getScaleUpPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scale up policy: %s", err.Error())
+	}
+	if !policy.RampEnabled || policy.RampStartWeight < 1 {
+		return nil, nil
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	weights := map[string]int64{}
+	for _, replica := range batch {
+		if replica.IPAddress != "" {
+			weights[replica.IPAddress] = policy.RampStartWeight
+		}
+	}
+	return weights, nil
+}
+
+// rampReplica raises the weight of the batch's new replicas in proxysql in
+// steps over the group's ramp duration, checking their health as it goes. If a
+// replica gets shunned, errors or lags, the ramp fails for good, which pulls
+// the batch through the scale up rollback. The current step is stored on the
+// incident details so a restart carries on from there.
+func rampReplica(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":     "rampReplica",
+		"incident": incident.IncidentID,
+	})
+	policy, err := getScaleUpPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get scale up policy: %s", err.Error())
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	if !policy.RampEnabled || len(batch) == 0 {
+		return models.StatusCheck, nil
+	}
+	groupWeights, err := backendWeights(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to work out backend weights: %s", err.Error())
+	}
+	full := map[string]int64{}
+	for _, replica := range batch {
+		weight, ok := groupWeights[replica.IPAddress]
+		if !ok {
+			return models.Fail, fmt.Errorf("%s isn't a replica of %s", replica.IPAddress, incident.SqlMasterInstance)
+		}
+		full[replica.IPAddress] = weight
+	}
+	details, err := getIncidentDetails(incident.IncidentID)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get incident details: %s", err.Error())
+	}
+	start := 0
+	if details.RampReplica == batch[0].Name {
+		start = details.RampStep
+	}
+	steps := policy.RampSteps
+	if steps < 1 {
+		steps = 1
+	}
+	interval := time.Duration(policy.RampDurationSeconds) * time.Second / time.Duration(steps)
+	names := strings.Join(batchNames(batch), ", ")
+	for i := start; i < steps; i++ {
+		_, err = updateIncidentDetails(incident.IncidentID, func(details *incidentDetails) {
+			details.RampReplica = batch[0].Name
+			details.RampStep = i
+		})
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to record ramp step: %s", err.Error())
+		}
+		for ip, weight := range full {
+			groupWeights[ip] = rampWeight(i, steps, policy.RampStartWeight, weight)
+		}
+		err = setProxySQLServerWeights(incident.SqlMasterInstance, groupWeights)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to set weights: %s", err.Error())
+		}
+		sendMessages([]byte(fmt.Sprintf("Ramping %s, step %d of %d \n IncidentID: %s \n Database: %s \n Project: %s", names, i+1, steps, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		if i == steps-1 {
+			break
+		}
+		baselines := map[string]proxySQLServerStat{}
+		for ip := range full {
+			baselines[ip], err = proxySQLServerStats(incident.SqlMasterInstance, ip)
+			if err != nil {
+				return models.Fail, fmt.Errorf("failed to read proxysql stats: %s", err.Error())
+			}
+		}
+		deadline := time.Now().Add(interval)
+		for time.Now().Before(deadline) {
+			select {
+			case <-time.After(rampPollInterval):
+			case <-ctx.Done():
+				return models.Fail, ctx.Err()
+			}
+			for ip, baseline := range baselines {
+				err = checkRampHealth(incident.SqlMasterInstance, ip, policy, baseline)
+				if err != nil {
+					if isPermanent(err) {
+						sendMessages([]byte(fmt.Sprintf("Aborting ramp of %s \n error: %s \n IncidentID: %s \n Database: %s \n Project: %s", names, err.Error(), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+					}
+					return models.Fail, err
+				}
+			}
+			funclog.Debugf("replicas healthy at step %d", i+1)
+		}
+	}
+	return models.StatusCheck, nil
+}
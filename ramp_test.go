@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRampWeight(t *testing.T) {
+	tests := []struct {
+		name              string
+		step, steps       int
+		start, full, want int64
+	}{
+		{name: "first step", step: 0, steps: 3, start: 10, full: 100, want: 10},
+		{name: "middle step", step: 1, steps: 3, start: 10, full: 100, want: 55},
+		{name: "last step", step: 2, steps: 3, start: 10, full: 100, want: 100},
+		{name: "past the last step", step: 5, steps: 3, start: 10, full: 100, want: 100},
+		{name: "single step", step: 0, steps: 1, start: 10, full: 100, want: 100},
+		{name: "start at or above full", step: 0, steps: 3, start: 100, full: 50, want: 50},
+		{name: "start below 1", step: 0, steps: 3, start: 0, full: 100, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rampWeight(tt.step, tt.steps, tt.start, tt.full); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
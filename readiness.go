@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// scaleUpPolicyKind is the per instance group entity that configures scale ups
+const scaleUpPolicyKind string = "chester_scale_up_policy"
+
+// replicaReadiness means the new replica has been created and is being
+// checked before it's added to the proxysql config.
+const replicaReadiness string = "replica_readiness"
+
+// readinessPollInterval is how often a new replica is checked while it catches up
+const readinessPollInterval = 15 * time.Second
+
+// scaleUpPolicy is stored per instance group to configure how replicas are added
+type scaleUpPolicy struct {
+	// MaxReplicationLagSeconds is the most a new replica can be behind the
+	// master before it gets traffic, defaults to 30
+	MaxReplicationLagSeconds int64
+	// ReadinessTimeoutSeconds is how long a new replica has to become ready
+	// before the scale up is rolled back, defaults to 1800
+	ReadinessTimeoutSeconds int
+	// RampEnabled adds new replicas to proxysql with a low weight and raises it in steps
+	RampEnabled bool
+	// RampSteps is the number of weights a new replica goes through, defaults to 5
+	RampSteps int
+	// RampStartWeight is the weight a new replica joins with, defaults to 10
+	RampStartWeight int64
+	// RampDurationSeconds is how long the whole ramp takes, defaults to 900
+	RampDurationSeconds int
+	// RampMaxErrorRate is the share of failed connections to a ramping replica
+	// that aborts the ramp, defaults to 0.05
+	RampMaxErrorRate float64
+}
+
+// getScaleUpPolicy gets the scale up policy for an instance group
+func getScaleUpPolicy(instanceGroup string) (scaleUpPolicy, error) {
+	policy := scaleUpPolicy{
+		MaxReplicationLagSeconds: 30,
+		ReadinessTimeoutSeconds:  1800,
+		RampSteps:                5,
+		RampStartWeight:          10,
+		RampDurationSeconds:      900,
+		RampMaxErrorRate:         0.05,
+	}
+	err := getGroupSetting(scaleUpPolicyKind, instanceGroup, &policy)
+	return policy, err
+}
+
+// checkReplicaReady returns nil if the replica is runnable, answers queries
+// and is within maxLag seconds of the master, otherwise the reason it isn't.
+func checkReplicaReady(ctx context.Context, instanceGroup, replicaName, ipAddress string, maxLag int64) error {
+	replica, err := getInstance(ctx, replicaName)
+	if err != nil {
+		return err
+	}
+	if replica.State != "RUNNABLE" {
+		return fmt.Errorf("replica state is %s", replica.State)
+	}
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return err
+	}
+	db, err := openReplica(ipAddress, psqlConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var one int
+	if err := db.QueryRow("SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("test query failed: %s", err.Error())
+	}
+	lag, err := replicationLag(ipAddress, psqlConfig)
+	if err != nil {
+		return err
+	}
+	if lag > maxLag {
+		return fmt.Errorf("replication lag is %ds, more than %ds", lag, maxLag)
+	}
+	return nil
+}
+
+// waitForReplicaReady waits until every new replica in the batch is healthy
+// and caught up, then adds them to the proxysql config in datastore. If one
+// isn't ready within the group's readiness timeout the step fails for good,
+// which rolls back the scale up.
+func waitForReplicaReady(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	policy, err := getScaleUpPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get scale up policy: %s", err.Error())
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+		return waitUntilReady(ctx, incident, replica, policy)
+	})
+	if err != nil {
+		return models.Fail, err
+	}
+	psqlConfig, err := getProxySQLConfig(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get proxysql config: %s", err.Error())
+	}
+	for _, r := range batch {
+		replica, err := getInstance(ctx, r.Name)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to getInstance with error %s", err.Error())
+		}
+		maxConnections, err := backendMaxConnections(incident.SqlMasterInstance, replica)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to work out max connections: %s", err.Error())
+		}
+		hostgroup, err := replicaHostgroup(incident.SqlMasterInstance, replica.Region, psqlConfig)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to get hostgroup for %s: %s", replica.Region, err.Error())
+		}
+		err = addReplicaToDatastore(incident.SqlMasterInstance, r.IPAddress, hostgroup, maxConnections)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to addReplicaToDatastore with error %s", err.Error())
+		}
+	}
+	return models.ConfigUpdate, nil
+}
+
+// waitUntilReady polls a new replica until it's ready, returning a permanent
+// error if the group's readiness timeout passes first.
+func waitUntilReady(ctx context.Context, incident *models.DataStoreIncident, replica batchReplica, policy scaleUpPolicy) error {
+	funclog := log.WithFields(log.Fields{
+		"func":     "waitUntilReady",
+		"incident": incident.IncidentID,
+		"replica":  replica.Name,
+	})
+	timeout := time.Duration(policy.ReadinessTimeoutSeconds) * time.Second
+	sendMessages([]byte(fmt.Sprintf("Waiting for replica %s to catch up \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkReplicaReady(ctx, incident.SqlMasterInstance, replica.Name, replica.IPAddress, policy.MaxReplicationLagSeconds)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			reason := fmt.Errorf("replica %s not ready after %s: %s", replica.Name, timeout, err.Error())
+			sendMessages([]byte(fmt.Sprintf("Replica failed readiness check \n error: %s \n IncidentID: %s \n Database: %s \n Project: %s", reason.Error(), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			return permanent(reason)
+		}
+		funclog.Debugf("replica not ready: %s", err.Error())
+		select {
+		case <-time.After(readinessPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	sendMessages([]byte(fmt.Sprintf("Replica %s is ready \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+
+	models "github.com/eahrend/chestermodels"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// regionPolicyKind is the per instance group entity that declares secondary regions
+const regionPolicyKind string = "chester_region_policy"
+
+// secondaryRegion is a region outside the master's that keeps its own read replicas
+type secondaryRegion struct {
+	// Region is the cloud sql region, like us-east1
+	Region string
+	// MinReplicas is the number of replicas kept in the region, scale ups fill
+	// this before adding replicas anywhere else
+	MinReplicas int
+	// MaxReplicas is the most replicas chester creates in the region
+	MaxReplicas int
+	// Hostgroup is the proxysql hostgroup the region's replicas are added to,
+	// so a proxysql deployment in the region can read locally. It's required
+	// and can't be the write hostgroup.
+	Hostgroup int
+}
+
+// regionPolicy is stored per instance group to declare its secondary regions
+type regionPolicy struct {
+	Regions []secondaryRegion
+}
+
+// getRegionPolicy gets the region policy for an instance group. A policy with
+// an invalid region is a permanent error, retrying won't fix the entity.
+func getRegionPolicy(instanceGroup string) (regionPolicy, error) {
+	policy := regionPolicy{}
+	err := getGroupSetting(regionPolicyKind, instanceGroup, &policy)
+	if err != nil || len(policy.Regions) == 0 {
+		return policy, err
+	}
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return policy, err
+	}
+	err = policy.validate(psqlConfig.WriteHostGroup)
+	if err != nil {
+		return policy, permanent(fmt.Errorf("invalid %s for %s: %s", regionPolicyKind, instanceGroup, err.Error()))
+	}
+	return policy, nil
+}
+
+// validate checks every secondary region has a hostgroup of its own, an unset
+// hostgroup is 0 which would make its replicas writers on most setups
+func (p regionPolicy) validate(writeHostGroup int) error {
+	for _, r := range p.Regions {
+		if r.Region == "" {
+			return fmt.Errorf("a region is missing its name")
+		}
+		if r.Hostgroup == 0 {
+			return fmt.Errorf("region %s has no hostgroup", r.Region)
+		}
+		if r.Hostgroup == writeHostGroup {
+			return fmt.Errorf("region %s uses the write hostgroup %d", r.Region, writeHostGroup)
+		}
+	}
+	return nil
+}
+
+// secondary returns the secondary region settings for a region, if it's one
+func (p regionPolicy) secondary(region string) (secondaryRegion, bool) {
+	for _, r := range p.Regions {
+		if r.Region == region {
+			return r, true
+		}
+	}
+	return secondaryRegion{}, false
+}
+
+// countByRegion counts replicas per region
+func countByRegion(replicas []*sqladmin.DatabaseInstance) map[string]int {
+	count := map[string]int{}
+	for _, replica := range replicas {
+		count[replica.Region]++
+	}
+	return count
+}
+
+// primaryCount counts the replicas that aren't in a secondary region, which
+// are the ones the group's own min and max replicas apply to
+func (p regionPolicy) primaryCount(replicas []*sqladmin.DatabaseInstance) int {
+	n := 0
+	for _, replica := range replicas {
+		if _, ok := p.secondary(replica.Region); !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// pickRegion picks the region for a new replica. Secondary regions under
+// their minimum come first, then the region that is least full against its
+// max, so secondary regions scale with load alongside the master's region.
+// Ties go to the master's region.
+func (p regionPolicy) pickRegion(masterRegion string, replicas []*sqladmin.DatabaseInstance, maxReplicas int) (string, error) {
+	count := countByRegion(replicas)
+	for _, r := range p.Regions {
+		if r.Region == masterRegion {
+			continue
+		}
+		if count[r.Region] < r.MinReplicas && count[r.Region] < r.MaxReplicas {
+			return r.Region, nil
+		}
+	}
+	picked, pickedFill := "", 0.0
+	consider := func(region string, n, max int) {
+		if n >= max {
+			return
+		}
+		fill := float64(n) / float64(max)
+		if picked == "" || fill < pickedFill {
+			picked, pickedFill = region, fill
+		}
+	}
+	consider(masterRegion, p.primaryCount(replicas), maxReplicas)
+	for _, r := range p.Regions {
+		if r.Region != masterRegion {
+			consider(r.Region, count[r.Region], r.MaxReplicas)
+		}
+	}
+	if picked == "" {
+		return "", permanent(fmt.Errorf("max instances reached"))
+	}
+	return picked, nil
+}
+
+// pickReplicaRegion picks the region for a new replica with the group's region policy
+func pickReplicaRegion(instanceGroup, masterRegion string, replicas []*sqladmin.DatabaseInstance, maxReplicas int) (string, error) {
+	policy, err := getRegionPolicy(instanceGroup)
+	if err != nil {
+		return "", err
+	}
+	return policy.pickRegion(masterRegion, replicas, maxReplicas)
+}
+
+// removable filters out replicas whose region is at or below its minimum,
+// minReplicas for replicas outside the secondary regions and each secondary
+// region's own minimum for the rest.
+func (p regionPolicy) removable(replicas []*sqladmin.DatabaseInstance, minReplicas int) []*sqladmin.DatabaseInstance {
+	count := countByRegion(replicas)
+	primary := p.primaryCount(replicas)
+	removable := []*sqladmin.DatabaseInstance{}
+	for _, replica := range replicas {
+		if r, ok := p.secondary(replica.Region); ok {
+			if count[replica.Region] <= r.MinReplicas {
+				continue
+			}
+		} else if primary <= minReplicas {
+			continue
+		}
+		removable = append(removable, replica)
+	}
+	return removable
+}
+
+// removableReplicas filters the replicas down to those a scale down may remove
+// with the group's region policy
+func removableReplicas(instanceGroup string, replicas []*sqladmin.DatabaseInstance, minReplicas int) ([]*sqladmin.DatabaseInstance, error) {
+	policy, err := getRegionPolicy(instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	return policy.removable(replicas, minReplicas), nil
+}
+
+// replicaHostgroup returns the proxysql hostgroup a replica in a region reads from
+func replicaHostgroup(instanceGroup, region string, psqlConfig *models.ProxySqlConfig) (int, error) {
+	policy, err := getRegionPolicy(instanceGroup)
+	if err != nil {
+		return 0, err
+	}
+	if r, ok := policy.secondary(region); ok {
+		return r.Hostgroup, nil
+	}
+	return psqlConfig.ReadHostGroup, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// replicasIn returns a replica in each of the regions given
+func replicasIn(regions ...string) []*sqladmin.DatabaseInstance {
+	replicas := []*sqladmin.DatabaseInstance{}
+	for _, region := range regions {
+		replicas = append(replicas, &sqladmin.DatabaseInstance{Name: region, Region: region})
+	}
+	return replicas
+}
+
+func TestPickRegion(t *testing.T) {
+	policy := regionPolicy{Regions: []secondaryRegion{
+		{Region: "us-west1", MinReplicas: 1, MaxReplicas: 2},
+	}}
+	tests := []struct {
+		name        string
+		policy      regionPolicy
+		replicas    []*sqladmin.DatabaseInstance
+		maxReplicas int
+		want        string
+		wantErr     bool
+	}{
+		{name: "no secondary regions", replicas: replicasIn("us-east1"), maxReplicas: 3, want: "us-east1"},
+		{name: "no secondary regions at max", replicas: replicasIn("us-east1", "us-east1"), maxReplicas: 2, wantErr: true},
+		{name: "secondary under its min comes first", policy: policy, maxReplicas: 4, want: "us-west1"},
+		{name: "ties go to the master's region", policy: policy, replicas: replicasIn("us-west1", "us-east1", "us-east1"), maxReplicas: 4, want: "us-east1"},
+		{name: "least full region", policy: policy, replicas: replicasIn("us-west1", "us-east1", "us-east1", "us-east1"), maxReplicas: 4, want: "us-west1"},
+		{name: "secondary scales once the master's region is full", policy: policy, replicas: replicasIn("us-west1", "us-east1", "us-east1"), maxReplicas: 2, want: "us-west1"},
+		{name: "secondary replicas don't count toward the group max", policy: policy, replicas: replicasIn("us-west1", "us-west1", "us-east1"), maxReplicas: 2, want: "us-east1"},
+		{name: "every region at max", policy: policy, replicas: replicasIn("us-west1", "us-west1", "us-east1", "us-east1"), maxReplicas: 2, wantErr: true},
+		{name: "secondary min above its max", policy: regionPolicy{Regions: []secondaryRegion{{Region: "us-west1", MinReplicas: 3, MaxReplicas: 1}}}, replicas: replicasIn("us-west1"), maxReplicas: 1, want: "us-east1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.pickRegion("us-east1", tt.replicas, tt.maxReplicas)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !isPermanent(err) {
+				t.Errorf("max instances reached should be permanent")
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovable(t *testing.T) {
+	policy := regionPolicy{Regions: []secondaryRegion{
+		{Region: "us-west1", MinReplicas: 1, MaxReplicas: 3},
+	}}
+	tests := []struct {
+		name        string
+		replicas    []*sqladmin.DatabaseInstance
+		minReplicas int
+		want        int
+	}{
+		{name: "everything above the mins", replicas: replicasIn("us-east1", "us-east1", "us-west1", "us-west1"), minReplicas: 1, want: 4},
+		{name: "master's region at its min", replicas: replicasIn("us-east1", "us-west1", "us-west1"), minReplicas: 1, want: 2},
+		{name: "secondary at its min", replicas: replicasIn("us-east1", "us-east1", "us-west1"), minReplicas: 1, want: 2},
+		{name: "every region at its min", replicas: replicasIn("us-east1", "us-west1"), minReplicas: 1, want: 0},
+		{name: "secondary replicas don't count toward the group min", replicas: replicasIn("us-east1", "us-west1", "us-west1", "us-west1"), minReplicas: 2, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.removable(tt.replicas, tt.minReplicas); len(got) != tt.want {
+				t.Errorf("got %d removable replicas, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestRegionPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		region  secondaryRegion
+		wantErr bool
+	}{
+		{name: "own hostgroup", region: secondaryRegion{Region: "us-west1", Hostgroup: 30}},
+		{name: "hostgroup unset", region: secondaryRegion{Region: "us-west1"}, wantErr: true},
+		{name: "write hostgroup", region: secondaryRegion{Region: "us-west1", Hostgroup: 5}, wantErr: true},
+		{name: "region unset", region: secondaryRegion{Hostgroup: 30}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := regionPolicy{Regions: []secondaryRegion{tt.region}}
+			if err := policy.validate(5); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// rollbackConfig means a scale up failed after the replica was created, and
+// the daemon is removing the replica from the proxysql config.
+const rollbackConfig string = "rollback_config"
+
+// rollbackReplica means the replicas are out of the proxysql config and the
+// daemon is deleting the orphaned replicas, or returning pooled ones to their pool.
+const rollbackReplica string = "rollback_replica"
+
+// rollbackWait means the daemon is waiting for the orphaned replicas to be deleted or stopped.
+const rollbackWait string = "rollback_wait"
+
+// rollbackProxySQLConfig removes the failed batch's IPs from the proxysql config
+// in datastore, then rebuilds the configmap and reloads proxysql. The configmap is
+// generated from datastore, so rebuilding it restores the config from before the
+// scale up. The create operations are cleared so the deletes get their own operations.
+// If no replicas were planned there is nothing to undo, so the incident closes
+// without touching proxysql.
+func rollbackProxySQLConfig(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":     "rollbackProxySQLConfig",
+		"incident": incident.IncidentID,
+	})
+	details, err := getIncidentDetails(incident.IncidentID)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get incident details: %s", err.Error())
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	if len(batch) == 0 {
+		funclog.Infof("no replicas were planned, closing without a rollback")
+		return models.Closed, nil
+	}
+	sendMessages([]byte(fmt.Sprintf("Scale up failed, rolling back replicas %s \n step: %s \n error: %s \n IncidentID: %s \n Database: %s \n Project: %s", strings.Join(batchNames(batch), ", "), details.CompensatedStep, details.CompensationReason, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	for _, r := range batch {
+		ipAddress := r.IPAddress
+		if ipAddress == "" {
+			replica, err := findInstance(ctx, r.Name)
+			if err != nil {
+				return models.Fail, fmt.Errorf("failed to look up replica %s: %s", r.Name, err.Error())
+			}
+			if replica != nil {
+				ipAddress = getPrivateIP(replica.IpAddresses)
+			}
+		}
+		if ipAddress != "" {
+			funclog.Debugf("removing %s from the proxysql config", ipAddress)
+			err = removeReplicaFromDataStoreConfigMap(incident.SqlMasterInstance, ipAddress)
+			if err != nil {
+				return models.Fail, fmt.Errorf("failed to remove replica from datastore config: %s", err.Error())
+			}
+		}
+	}
+	err = updateConfigMap(incident.SqlMasterInstance, nil)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to restore configmap: %s", err.Error())
+	}
+	err = applyProxySQLConfig(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to reload proxysql: %s", err.Error())
+	}
+	for i := range batch {
+		batch[i].OperationID = ""
+	}
+	err = setBatch(incident.IncidentID, batch)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to clear operation ids: %s", err.Error())
+	}
+	err = updateOperationID(incident.IncidentID, "")
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to clear operation id: %s", err.Error())
+	}
+	incident.OperationID = ""
+	return rollbackReplica, nil
+}
+
+// rollbackBatch returns a step that undoes the batch's replicas, then moves
+// on to next. Replicas started from a pool go back to it stopped instead of
+// being deleted, batches stored before the pool was recorded go back warm.
+func rollbackBatch(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		batch, err := getBatch(incident)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+		}
+		err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+			if !replica.Pooled {
+				return deleteBatchReplica(ctx, incident, replica)
+			}
+			pool := replica.Pool
+			if pool == "" {
+				pool = poolWarm
+			}
+			return returnToPool(ctx, incident, replica, pool)
+		})
+		if err != nil {
+			return models.Fail, err
+		}
+		return next, nil
+	}
+}
+
+// finishRollback waits for the orphaned replicas to be deleted or stopped, then closes the incident.
+func finishRollback(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	next, err := waitForReplicaDeletion(models.Closed)(ctx, incident)
+	if err != nil {
+		return next, err
+	}
+	sendMessages([]byte(fmt.Sprintf("Rolled back failed scale up, closing incident \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	return next, nil
+}
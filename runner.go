@@ -2,396 +2,824 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/pubsub"
 	models "github.com/eahrend/chestermodels"
 	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
-// run is the main runner function, handles retreiving events from pub/sub
-func run() error {
+// run is the main runner function, handles retreiving events from pub/sub.
+// The pubsub client calls the handler from multiple goroutines, so incidents
+// for different instance groups are processed concurrently, and the instance
+// group lease keeps two incidents from mutating the same group.
+// Messages are only acked once the incident is done, the pubsub client keeps
+// extending the ack deadline while we work, up to ackMaxExtension.
+func run(ctx context.Context) error {
 	funclog := log.WithFields(log.Fields{
 		"func": "run",
 	})
 	funclog.Debugln("Checking datastore for config")
 	funclog.Debugln("Starting message Subscription polling")
-	err := subscription.Receive(context.Background(), func(ctx context.Context, m *pubsub.Message) {
+	subscription.ReceiveSettings.MaxOutstandingMessages = maxConcurrentIncidents
+	subscription.ReceiveSettings.MaxExtension = ackMaxExtension
+	err := subscription.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
 		funclog.Debugln("!!!MESSAGE RECEIVED!!!")
-		m.Ack()
-		handleEvent(m)
+		handleEvent(ctx, m)
 	})
-	funclog.Errorln("Received error from subscription receive: %s", err.Error())
+	if err == nil {
+		// Receive only returns nil once ctx is done
+		err = fmt.Errorf("stopped receiving messages: %s", ctx.Err())
+	}
+	funclog.Errorf("Received error from subscription receive: %s", err.Error())
 	return err
 }
 
-// handleEvent processes message from pubsub and determines
-// what to do with it
-func handleEvent(message *pubsub.Message) {
+// handleEvent processes message from pubsub, and acks it once the incident
+// reaches a terminal state. Failures are retried or dead lettered, and
+// messages that fail validation are quarantined.
+func handleEvent(ctx context.Context, message *pubsub.Message) {
 	funclog := log.WithFields(log.Fields{
 		"func": "handleEvent",
 	})
-	var m models.DataStoreIncident
-	messageBytes := message.Data
-	dec := json.NewDecoder(strings.NewReader(string(messageBytes)))
-	if err := dec.Decode(&m); err == io.EOF {
-		funclog.Fatal("Failed to decode the message")
-	} else if err != nil {
-		funclog.Fatal("Failed to Decode message: ", err)
-	}
-	switch action := m.Action; action {
+	m, err := decodeIncident(message.Data)
+	if err != nil {
+		err = quarantineMessage(message, m.IncidentID, err)
+		if err != nil {
+			funclog.Errorf("failed to quarantine message %s: %s", message.ID, err.Error())
+			message.Nack()
+			return
+		}
+		message.Ack()
+		return
+	}
+	err = processIncident(ctx, m)
+	if err != nil {
+		retryOrDeadLetter(ctx, message, m.IncidentID, err)
+		return
+	}
+	message.Ack()
+	// incidents clean up their own details when they close
+	if m.IncidentID == "" {
+		if err := deleteIncidentDetails(detailsID(message, m.IncidentID)); err != nil {
+			funclog.Errorf("failed to clean up message details: %s", err.Error())
+		}
+	}
+}
+
+// processIncident takes the instance group lease and runs the incident
+// through the workflow for its action. A nil error means the incident is
+// finished and its message can be acked.
+func processIncident(ctx context.Context, m models.DataStoreIncident) error {
+	funclog := log.WithFields(log.Fields{
+		"func":     "processIncident",
+		"incident": m.IncidentID,
+	})
+	leaseCtx, release, err := holdLease(ctx, m.SqlMasterInstance, m.IncidentID)
+	if err != nil {
+		return fmt.Errorf("failed to get lease on instance group %s: %s", m.SqlMasterInstance, err.Error())
+	}
+	defer release()
+	if m.Action != "restart" {
+		// another incident may have held the lease while we waited, and the
+		// message itself may be a stale copy, so pick up where datastore says we are
+		m, err = getIncident(m.IncidentID)
+		if err == datastore.ErrNoSuchEntity {
+			funclog.Debugf("incident has already been cleared")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to get incident: %s", err.Error())
+		}
+		if m.LastProcess == deadLettered {
+			funclog.Warnf("incident was dead lettered, skipping")
+			return nil
+		}
+	}
+	var status string
+	switch m.Action {
 	case "add":
 		funclog.Debugln("Add Action")
-		status, err := addReplica(m)
+		status, err = addReplica(leaseCtx, m)
 		if err != nil {
-			log.Errorf("failed to add replica with error: %s on process: %s", err.Error(), status)
+			funclog.Errorf("failed to add replica with error: %s on process: %s", err.Error(), status)
 		}
-		funclog.Debugf("Finished with status of %s", status)
 	case "remove":
 		funclog.Debugln("Remove Action")
-		status, err := removeReplica(m)
+		status, err = removeReplica(leaseCtx, m)
 		if err != nil {
 			funclog.Errorf("failed to remove replica with error: %s on process: %s", err.Error(), status)
 		}
-		funclog.Debugf("Finished with status of %s", status)
 	case "restart":
 		funclog.Debugln("Restart proxysql")
-		status, err := restartProxySQL(m)
+		status, err = restartProxySQL(m)
 		if err != nil {
 			funclog.Errorf("failed to restart proxysql with error: %s on process: %s", err.Error(), status)
 		}
-		funclog.Debugf("Finished with status of %s", status)
-	default:
-		funclog.Debugf("Failed to find proper action.\n Message %v \n Action: %s", m, action)
 	}
+	funclog.Debugf("Finished with status of %s", status)
+	return err
+}
+
+// instanceDelete means the daemon is about to delete, or has asked the sqladmin
+// API to delete, the replicas in the incident's batch.
+const instanceDelete string = "instance_delete"
+
+// operationWait means the daemon is waiting on the batch's sqladmin
+// operations before moving on.
+const operationWait string = "operation_wait"
+
+// addReplicaMachine is the workflow used for "add" incidents
+var addReplicaMachine = newAddReplicaMachine()
+
+// removeReplicaMachine is the workflow used for "remove" incidents
+var removeReplicaMachine = newRemoveReplicaMachine()
+
+// newAddReplicaMachine registers the steps used to scale up an instance group
+func newAddReplicaMachine() *stateMachine {
+	return newStateMachine("addReplica").
+		onClose(rollbackConfig).
+		register(step{
+			name:       models.GCFPush,
+			run:        ackAddIncident,
+			next:       []string{models.DaemonAck},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		}).
+		register(step{
+			name:       models.DaemonAck,
+			run:        createReplica,
+			next:       []string{models.InstanceInsert, models.Closed},
+			timeout:    time.Hour,
+			retries:    2,
+			retryDelay: 30 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name:       models.InstanceInsert,
+			run:        waitForReplica,
+			next:       []string{replicaReadiness},
+			timeout:    time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name:       replicaReadiness,
+			run:        waitForReplicaReady,
+			next:       []string{models.ConfigUpdate},
+			timeout:    2 * time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name:       models.ConfigUpdate,
+			run:        updateProxySQLConfigMap,
+			next:       []string{models.ProxysqlRestart},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name:       models.ProxysqlRestart,
+			run:        reloadProxySQLConfig(replicaRamp),
+			next:       []string{replicaRamp},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name:       replicaRamp,
+			run:        rampReplica,
+			next:       []string{models.StatusCheck},
+			timeout:    2 * time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+			compensate: rollbackConfig,
+		}).
+		register(step{
+			name: models.StatusCheck,
+			run:  coolDown,
+			next: []string{models.DaemonAck, models.Closed},
+		}).
+		register(step{
+			name:       models.Closed,
+			run:        closeIncident,
+			next:       []string{models.Clear},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		}).
+		register(step{
+			name:       rollbackConfig,
+			run:        rollbackProxySQLConfig,
+			next:       []string{rollbackReplica, models.Closed},
+			retries:    5,
+			retryDelay: 30 * time.Second,
+		}).
+		register(step{
+			name:       rollbackReplica,
+			run:        rollbackBatch(rollbackWait),
+			next:       []string{rollbackWait},
+			timeout:    time.Hour,
+			retries:    5,
+			retryDelay: 30 * time.Second,
+		}).
+		register(step{
+			name:       rollbackWait,
+			run:        finishRollback,
+			next:       []string{models.Closed},
+			timeout:    time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+		})
+}
+
+// newRemoveReplicaMachine registers the steps used to scale down an instance group
+func newRemoveReplicaMachine() *stateMachine {
+	deleteStep := step{
+		name:       instanceDelete,
+		run:        removeBatch(operationWait),
+		next:       []string{operationWait},
+		timeout:    time.Hour,
+		retries:    2,
+		retryDelay: 30 * time.Second,
+	}
+	// incidents persisted before instanceDelete existed used InstanceInsert
+	// to mean the replica was about to be deleted
+	legacyDeleteStep := deleteStep
+	legacyDeleteStep.name = models.InstanceInsert
+	return newStateMachine("removeReplica").
+		onClose(models.Closed).
+		register(step{
+			name:       models.GCFPush,
+			run:        ackRemoveIncident,
+			next:       []string{models.DaemonAck},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		}).
+		register(step{
+			name:       models.DaemonAck,
+			run:        selectReplicaForRemoval,
+			next:       []string{replicaDrain, models.Closed},
+			retries:    2,
+			retryDelay: 30 * time.Second,
+		}).
+		register(step{
+			name:       replicaDrain,
+			run:        drainReplica,
+			next:       []string{models.ConfigUpdate},
+			timeout:    time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+		}).
+		register(step{
+			name:       models.ConfigUpdate,
+			run:        updateProxySQLConfigMap,
+			next:       []string{models.ProxysqlRestart},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		}).
+		register(step{
+			name:       models.ProxysqlRestart,
+			run:        reloadProxySQLConfig(instanceDelete),
+			next:       []string{instanceDelete},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		}).
+		register(deleteStep).
+		register(legacyDeleteStep).
+		register(step{
+			name:       operationWait,
+			run:        waitForReplicaDeletion(models.StatusCheck),
+			next:       []string{models.StatusCheck},
+			timeout:    time.Hour,
+			retries:    3,
+			retryDelay: 30 * time.Second,
+		}).
+		register(step{
+			name: models.StatusCheck,
+			run:  coolDown,
+			next: []string{models.DaemonAck, models.Closed},
+		}).
+		register(step{
+			name:       models.Closed,
+			run:        closeIncident,
+			next:       []string{models.Clear},
+			retries:    3,
+			retryDelay: 5 * time.Second,
+		})
 }
 
 // addReplica adds a new read replica to the list of readers.
-// This is handled recursively, in case the pod needs to restart
-func addReplica(incident models.DataStoreIncident) (string, error) {
+// The work is done by addReplicaMachine, which resumes from the
+// persisted LastProcess in case the pod needs to restart.
+func addReplica(ctx context.Context, incident models.DataStoreIncident) (string, error) {
+	return addReplicaMachine.run(ctx, incident)
+}
+
+// removeReplica removes a chester created replica from the list of readers.
+func removeReplica(ctx context.Context, incident models.DataStoreIncident) (string, error) {
+	return removeReplicaMachine.run(ctx, incident)
+}
+
+// ackAddIncident lets slack know we've picked up a scale up incident
+func ackAddIncident(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	sendMessages([]byte(fmt.Sprintf("Received a scale up message \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	return models.DaemonAck, nil
+}
+
+// ackRemoveIncident lets slack know we've picked up a scale down incident
+func ackRemoveIncident(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	sendMessages([]byte(fmt.Sprintf("Received scale down alert \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	return models.DaemonAck, nil
+}
+
+// createReplica plans the batch of replicas to add in this loop, then asks
+// the sqladmin API for all of them at once, starting warm replicas instead
+// of creating new ones where it can. The batch is stored before the
+// create calls, so resuming after a crash finds the replicas that were
+// created instead of creating more. An incident that closed before its batch
+// was planned closes without creating anything, one that closed after goes
+// on to roll its batch back.
+func createReplica(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
 	funclog := log.WithFields(log.Fields{
-		"func":     "addReplica",
+		"func":     "createReplica",
 		"incident": incident.IncidentID,
 	})
-	if incident.State == models.Closed {
-		funclog.Debugf("received closed state from GCF")
-		return "", nil
-	}
-	switch lastProcess := incident.LastProcess; lastProcess {
-	case models.GCFPush:
-		sendMessages([]byte(fmt.Sprintf("Received a scale up message \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := updateLastProcess(incident.IncidentID, models.DaemonAck)
-		if err != nil {
-			funclog.WithField("lastProcess", models.GCFPush).Errorf("failed to update last process with error %s", err.Error())
-			return models.Fail, err
-		}
-		incident.LastProcess = models.DaemonAck
-		return addReplica(incident)
-	case models.DaemonAck:
-		instances := getInstances("", "settings.userLabels.chester:true")
-		chesterMetaData, err := getChesterMetaData(incident.SqlMasterInstance)
-		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to get chester metadata with error %s", err.Error())
-			return "fail", err
-		}
-		if len(instances) >= chesterMetaData.MaxChesterInstances {
-			funclog.Warnf("max instances reached")
-			sendMessages([]byte(fmt.Sprintf("Too many instances, need to modify the scaling threshold, JIRA ticket soon to come \n IncidentID: %s \n Database: %s \n ProjectID: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			return "fail", fmt.Errorf("max instances reached")
-		}
-		instanceName := generateInstanceName(incident)
-		funclog.Debugln("Creating Database replica with name of:", instanceName)
-		sendMessages([]byte(fmt.Sprintf("Creating new database replica with name: %s \n IncidentID: %s \n Database: %s \n Project: %s", instanceName, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		masterData, err := getInstance(incident.SqlMasterInstance)
-		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to get instance with error %s", err.Error())
-			return models.Fail, err
-		}
-		operationID, err := createDatabaseReplica(incident.SqlMasterInstance, masterData.Settings.UserLabels, masterData.Settings.DatabaseFlags, masterData.Region, instanceName, masterData.Settings.DataDiskSizeGb, masterData.Settings.Tier)
-		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to get operationID with error %s", err.Error())
-			return models.Fail, err
-		}
-		incident.LastProcess = models.InstanceInsert
-		incident.OperationID = operationID
-		incident.LastReadReplicaName = instanceName
-		err = updateLastProcess(incident.IncidentID, models.InstanceInsert)
-		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-			return models.Fail, err
-		}
-		err = updateLastReadReplica(incident.IncidentID, instanceName)
-		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to UpdateLastReadReplica with error %s", err.Error())
-			return models.Fail, err
-		}
-		err = updateOperationID(incident.IncidentID, operationID)
+	masterData, err := getInstance(ctx, incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get instance with error %s", err.Error())
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch with error %s", err.Error())
+	}
+	err = checkIncidentCurrent(ctx)
+	if errors.Is(err, errIncidentClosed) && len(batch) == 0 {
+		sendMessages([]byte(fmt.Sprintf("Incident closed before any replica was created, closing \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		return models.Closed, nil
+	}
+	if err != nil {
+		return models.Fail, err
+	}
+	if len(batch) == 0 {
+		batch, err = planBatch(ctx, incident, masterData)
 		if err != nil {
-			funclog.WithField("lastProcess", models.DaemonAck).Errorf("failed to UpdateOperationID with error %s", err.Error())
+			if isPermanent(err) {
+				funclog.Warnf("max instances reached")
+				sendMessages([]byte(fmt.Sprintf("Too many instances, need to modify the scaling threshold, JIRA ticket soon to come \n IncidentID: %s \n Database: %s \n ProjectID: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			}
 			return models.Fail, err
 		}
-		return addReplica(incident)
-	case models.InstanceInsert:
-		sendMessages([]byte(fmt.Sprintf("Waiting on operation: %s \n IncidentID: %s \n Database: %s \n Project: %s", incident.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := waitForOperation(incident.OperationID)
+		err = setBatch(incident.IncidentID, batch)
 		if err != nil {
-			sendMessages([]byte(fmt.Sprintf("Failed for wait operation: %s \n IncidentID: %s \n Database: %s \n Project: %s", err.Error(), incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			funclog.WithField("lastProcess", models.InstanceInsert).Errorf("failed to waitForOperation with error %s", err.Error())
-			return models.Fail, err
+			return models.Fail, fmt.Errorf("failed to store batch with error %s", err.Error())
 		}
-		sendMessages([]byte(fmt.Sprintf("Operation succeeded \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		dbs, err := getInstance(incident.LastReadReplicaName)
+		last := batch[len(batch)-1].Name
+		err = updateLastReadReplica(incident.IncidentID, last)
 		if err != nil {
-			funclog.WithField("lastProcess", models.InstanceInsert).Errorf("failed to getInstance with error %s", err.Error())
-			return models.Fail, err
+			return models.Fail, fmt.Errorf("failed to UpdateLastReadReplica with error %s", err.Error())
 		}
-		ipAddress := getPrivateIP(dbs.IpAddresses)
-		incident.LastIPAddress = ipAddress
-		err = updateLastIPAddress(incident.IncidentID, ipAddress)
-		if err != nil {
-			funclog.WithField("lastProcess", models.InstanceInsert).Errorf("failed to UpdateLastIPAddress with error %s", err.Error())
-			return models.Fail, err
+		incident.LastReadReplicaName = last
+	}
+	err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+		if replica.Pooled {
+			return startPooledReplica(ctx, incident, replica)
 		}
-		err = addReplicaToDatastore(incident.SqlMasterInstance, ipAddress)
+		existing, err := findInstance(ctx, replica.Name)
 		if err != nil {
-			funclog.WithField("lastProcess", models.InstanceInsert).Errorf("failed to UpdateLastIPAddress with error %s", err.Error())
-			return models.Fail, err
+			return fmt.Errorf("failed to look up replica %s with error %s", replica.Name, err.Error())
 		}
-		incident.LastProcess = models.ConfigUpdate
-		err = updateLastProcess(incident.IncidentID, models.ConfigUpdate)
-		if err != nil {
-			funclog.WithField("lastProcess", models.InstanceInsert).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-			return models.Fail, err
+		if existing != nil {
+			funclog.Infof("replica %s already exists, resuming", replica.Name)
+			return nil
 		}
-		return addReplica(incident)
-	case models.ConfigUpdate:
-		sendMessages([]byte(fmt.Sprintf("Updating k8s config \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := updateConfigMap(incident.SqlMasterInstance)
-		if err != nil {
-			funclog.WithField("lastProcess", models.ConfigUpdate).Errorf("failed to updateConfigMap with error %s", err.Error())
-			return models.Fail, err
+		region := replica.Region
+		if region == "" {
+			region = masterData.Region
 		}
-		incident.LastProcess = models.ProxysqlRestart
-		err = updateLastProcess(incident.IncidentID, models.ProxysqlRestart)
+		funclog.Debugln("Creating Database replica with name of:", replica.Name)
+		sendMessages([]byte(fmt.Sprintf("Creating new database replica with name: %s in %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, region, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		spec, err := buildReplicaSpec(replica.Name, region, replica.Zone, masterData, *incident)
 		if err != nil {
-			funclog.WithField("lastProcess", models.ConfigUpdate).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-			return models.Fail, err
+			return fmt.Errorf("failed to build replica spec with error %s", err.Error())
 		}
-		return addReplica(incident)
-	case models.ProxysqlRestart:
-		sendMessages([]byte(fmt.Sprintf("Rolling restart of proxysql instances \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := reloadProxySql(incident.SqlMasterInstance)
+		operationID, err := createDatabaseReplica(ctx, spec)
 		if err != nil {
-			funclog.WithField("lastProcess", models.ProxysqlRestart).Errorf("failed to reloadProxySql with error %s", err.Error())
-			return models.Fail, err
+			return fmt.Errorf("failed to get operationID with error %s", err.Error())
 		}
-		incident.LastProcess = models.StatusCheck
-		err = updateLastProcess(incident.IncidentID, models.StatusCheck)
+		return updateBatchReplica(incident.IncidentID, replica.Name, func(replica *batchReplica) {
+			replica.OperationID = operationID
+		})
+	})
+	if err != nil {
+		return models.Fail, err
+	}
+	// refill the warm pool and clear out old parked replicas behind the
+	// scale up, without holding it up
+	backfillWarmPool(*incident, masterData)
+	expireParkedReplicas(*incident)
+	return models.InstanceInsert, nil
+}
+
+// planBatch picks the name, region and zone of each replica to add in this
+// loop. The batch is the scaling policy's step size, or the alert's, cut
+// short at the max replicas. Parked and warm replicas in a region are
+// used before new ones are named. If not even one replica fits, it returns a
+// permanent error.
+func planBatch(ctx context.Context, incident *models.DataStoreIncident, masterData *sqladmin.DatabaseInstance) ([]batchReplica, error) {
+	policy, err := getScalingPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scaling policy with error %s", err.Error())
+	}
+	template, err := getReplicaTemplate(incident.SqlMasterInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replica template with error %s", err.Error())
+	}
+	instances, err := getGroupReplicas(ctx, incident.SqlMasterInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replicas for %s with error %s", incident.SqlMasterInstance, err.Error())
+	}
+	pooled, err := availablePooledReplicas(ctx, incident.SqlMasterInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pooled replicas for %s with error %s", incident.SqlMasterInstance, err.Error())
+	}
+	size := policy.StepSize
+	if alertSize := alertStepSize(*incident); alertSize > 0 {
+		size = alertSize
+	}
+	batch := []batchReplica{}
+	for len(batch) < size {
+		region, err := pickReplicaRegion(incident.SqlMasterInstance, masterData.Region, instances, policy.MaxReplicas)
 		if err != nil {
-			funclog.WithField("lastProcess", models.ProxysqlRestart).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-			return models.Fail, err
+			if isPermanent(err) && len(batch) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if available := pooled[region]; len(available) > 0 {
+			// starting a pooled replica is much quicker than creating one
+			batch = append(batch, batchReplica{
+				Name:   available[0].Name,
+				Region: region,
+				Zone:   replicaZone(available[0]),
+				Pooled: true,
+				Pool:   poolState(available[0]),
+			})
+			instances = append(instances, available[0])
+			pooled[region] = available[1:]
+			continue
+		}
+		zone := ""
+		if template.Placement == placementSpread {
+			zone, err = pickZone(incident.SqlMasterInstance, region, template.Zones, instances)
+			if err != nil {
+				return nil, err
+			}
 		}
-		return addReplica(incident)
-	case models.StatusCheck:
-		sendMessages([]byte(fmt.Sprintf("Starting cooldown period \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		funclog.Debugf("Starting cooldown timer for incident %s", incident.IncidentID)
-		status, err := coolDownTimer(incident)
-		funclog.Debugf("received return status from cooldown timer: %s", status)
-		if err != nil {
-			funclog.Errorf("received error from cooldown timer: %s", err.Error())
-			return models.Fail, err
+		replica := batchReplica{
+			Name:   generateInstanceName(*incident),
+			Region: region,
+			Zone:   zone,
 		}
-		if status != models.Closed {
-			sendMessages([]byte(fmt.Sprintf("Status not closed adding another replica \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			funclog.Debugf("status not closed, adding another replica")
-			incident.LastProcess = models.DaemonAck
-			err = updateLastProcess(incident.IncidentID, models.DaemonAck)
+		batch = append(batch, replica)
+		// count the planned replica when placing the next one
+		instances = append(instances, &sqladmin.DatabaseInstance{Name: replica.Name, Region: region, GceZone: zone})
+	}
+	return batch, nil
+}
+
+// waitForReplica waits for every replica in the batch to finish being
+// created, then stores their private IPs on the batch. If an operation ID
+// was never stored, it's looked up from the replica.
+func waitForReplica(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch with error %s", err.Error())
+	}
+	err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+		operationID := replica.OperationID
+		if operationID == "" {
+			var err error
+			operationType := "CREATE_REPLICA"
+			if replica.Pooled {
+				operationType = "UPDATE"
+			}
+			operationID, err = findOperation(ctx, replica.Name, operationType)
 			if err != nil {
-				funclog.WithField("lastProcess", models.StatusCheck).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-				return models.Fail, err
+				return fmt.Errorf("failed to find create operation with error %s", err.Error())
 			}
-			return addReplica(incident)
-		} else {
-			sendMessages([]byte(fmt.Sprintf("Incident closed \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			funclog.Debugf("status is listed as closed, ending loop")
-			incident.LastProcess = models.Closed
-			err = updateLastProcess(incident.IncidentID, "closed")
+		}
+		if operationID != "" {
+			sendMessages([]byte(fmt.Sprintf("Waiting on operation: %s for %s \n IncidentID: %s \n Database: %s \n Project: %s", operationID, replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			err := waitForOperation(ctx, operationID)
 			if err != nil {
-				funclog.WithField("lastProcess", models.StatusCheck).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-				return models.Fail, err
+				sendMessages([]byte(fmt.Sprintf("Failed for wait operation: %s \n IncidentID: %s \n Database: %s \n Project: %s", err.Error(), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+				return fmt.Errorf("failed to waitForOperation with error %w", err)
 			}
-			return addReplica(incident)
+			sendMessages([]byte(fmt.Sprintf("Operation succeeded for %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
 		}
-	case models.Closed:
-		// delete incident id
-		sendMessages([]byte(fmt.Sprintf("Incident closed \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := updateLastProcess(incident.IncidentID, models.Clear)
+		dbs, err := getInstance(ctx, replica.Name)
 		if err != nil {
-			funclog.WithField("lastProcess", models.Closed).Errorf("failed to UpdateLastProcess with error %s", err.Error())
-			return models.Fail, err
+			return fmt.Errorf("failed to getInstance with error %s", err.Error())
 		}
-		incident.LastProcess = models.Clear
-		_, err = deleteIncident(incident.IncidentID)
-		if err != nil {
-			funclog.WithField("lastProcess", models.Closed).Errorf("failed to DeleteIncident with error %s", err.Error())
-			return models.Fail, err
+		ipAddress := getPrivateIP(dbs.IpAddresses)
+		if ipAddress == "" {
+			return fmt.Errorf("replica %s doesn't have a private ip address yet", replica.Name)
+		}
+		return updateBatchReplica(incident.IncidentID, replica.Name, func(replica *batchReplica) {
+			replica.OperationID = operationID
+			replica.IPAddress = ipAddress
+		})
+	})
+	if err != nil {
+		return models.Fail, err
+	}
+	return replicaReadiness, nil
+}
+
+// updateProxySQLConfigMap rewrites the proxysql configmap from datastore
+func updateProxySQLConfigMap(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	sendMessages([]byte(fmt.Sprintf("Updating k8s config \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	startWeights, err := rampStartWeights(incident)
+	if err != nil {
+		return models.Fail, err
+	}
+	err = updateConfigMap(incident.SqlMasterInstance, startWeights)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to updateConfigMap with error %s", err.Error())
+	}
+	return models.ProxysqlRestart, nil
+}
+
+// reloadProxySQLConfig returns a step that gets the new config onto the
+// running proxysql pods, either live or with a rolling restart, then moves on to next.
+func reloadProxySQLConfig(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		if proxySQLApplyMode == applyModeLive {
+			sendMessages([]byte(fmt.Sprintf("Applying proxysql config live \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
 		} else {
-			return addReplica(incident)
+			sendMessages([]byte(fmt.Sprintf("Rolling restart of proxysql instances \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
 		}
-	default:
-		var err error
-		if lastProcess != models.Clear {
-			err = errors.New(fmt.Sprintf("unknown status %s", lastProcess))
+		err := applyProxySQLConfig(incident.SqlMasterInstance)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to applyProxySQLConfig with error %s", err.Error())
 		}
-		return lastProcess, err
+		return next, nil
 	}
 }
 
-// removeReplica removes a chester created replica from
-func removeReplica(incident models.DataStoreIncident) (string, error) {
+// coolDown waits out the cooldown period once a step's worth of replicas
+// is done, then either loops back around for more or closes the incident.
+func coolDown(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
 	funclog := log.WithFields(log.Fields{
-		"func":     "removeReplica",
+		"func":     "coolDown",
 		"incident": incident.IncidentID,
 	})
-	if incident.State == models.Closed {
-		funclog.Debugf("received closed state from GCF")
-		return "", nil
-	}
-	switch lastProcess := incident.LastProcess; lastProcess {
-	case models.GCFPush:
-		sendMessages([]byte(fmt.Sprintf("Received scale down alert \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := updateLastProcess(incident.IncidentID, models.DaemonAck)
-		if err != nil {
-			return models.Fail, err
-		}
-		incident.LastProcess = models.DaemonAck
-		return removeReplica(incident)
-	case models.DaemonAck:
-		// get a list of the instances and make the call to remove one
-		// TODO: Probably need to alert on this issue
-		instances := getInstances("", "settings.userLabels.chester:true")
-		if len(instances) == 0 {
-			sendMessages([]byte(fmt.Sprintf("Scale down failed, threshold too low, JIRA ticket to come \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			return models.Closed, nil
-		}
-		sendMessages([]byte(fmt.Sprintf("Removing instance: %s \n IncidentID: %s \n Database: %s \n Project: %s", instances[0].Name, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		h, err := getInstance(instances[0].Name)
-		if err != nil {
-			funclog.Errorf("failed to find instance: %s", err.Error())
-			return models.Fail, err
-		}
-		ip := getPrivateIP(h.IpAddresses)
-		err = updateLastIPAddress(incident.IncidentID, ip)
-		if err != nil {
-			funclog.Errorf("failed to update last ip address: %s", err.Error())
-			return models.Fail, err
-		}
-		incident.LastReadReplicaName = h.Name
-		err = updateLastReadReplica(incident.IncidentID, h.Name)
-		if err != nil {
-			funclog.Errorf("failed to update last ip address: %s", err.Error())
-			return models.Fail, err
-		}
-		err = removeReplicaFromDataStoreConfigMap(incident.SqlMasterInstance, ip)
-		if err != nil {
-			funclog.Errorf("failed to update last ip address: %s", err.Error())
-			return models.Fail, err
+	policy, err := getScalingPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get scaling policy: %s", err.Error())
+	}
+	if policy.expired(*incident) {
+		sendMessages([]byte(fmt.Sprintf("Incident ran longer than %ds, closing \n IncidentID: %s \n Database: %s \n Project: %s", policy.MaxIncidentDurationSeconds, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		return models.Closed, nil
+	}
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	// count the batch towards the step once, even if this is a resume
+	details, err := updateIncidentDetails(incident.IncidentID, func(details *incidentDetails) {
+		if len(batch) == 0 {
+			details.StepCount++
+		} else if details.StepLastReplica != batch[0].Name {
+			details.StepCount += len(batch)
+			details.StepLastReplica = batch[0].Name
 		}
-		incident.LastProcess = models.ConfigUpdate
-		err = updateLastProcess(incident.IncidentID, models.ConfigUpdate)
-		return removeReplica(incident)
-	case models.ConfigUpdate:
-		err := updateConfigMap(incident.SqlMasterInstance)
+	})
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to count step: %s", err.Error())
+	}
+	wait := policy.cooldown(incident.Action)
+	stepDone := details.StepCount >= policy.StepSize
+	if stepDone {
+		sendMessages([]byte(fmt.Sprintf("Starting cooldown period of %s \n IncidentID: %s \n Database: %s \n Project: %s", wait, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	} else {
+		funclog.Debugf("%d of %d replicas in this step, skipping cooldown", details.StepCount, policy.StepSize)
+		wait = 0
+	}
+	status, err := coolDownTimer(ctx, *incident, wait)
+	funclog.Debugf("received return status from cooldown timer: %s", status)
+	if err != nil {
+		return models.Fail, fmt.Errorf("received error from cooldown timer: %s", err.Error())
+	}
+	closedMessage, continueMessage := "Incident closed", "Status not closed adding another replica"
+	if incident.Action == "remove" {
+		closedMessage, continueMessage = "Removal Incident closed", "Cooldown period passed, removing another instance"
+	}
+	if status == models.Closed {
+		sendMessages([]byte(fmt.Sprintf("%s \n IncidentID: %s \n Database: %s \n Project: %s", closedMessage, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		funclog.Debugf("status is listed as closed, ending loop")
+		return models.Closed, nil
+	}
+	sendMessages([]byte(fmt.Sprintf("%s \n IncidentID: %s \n Database: %s \n Project: %s", continueMessage, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	if stepDone {
+		_, err = updateIncidentDetails(incident.IncidentID, func(details *incidentDetails) {
+			details.StepCount = 0
+		})
 		if err != nil {
-			return models.Fail, err
+			return models.Fail, fmt.Errorf("failed to reset step: %s", err.Error())
 		}
-		incident.LastProcess = models.ProxysqlRestart
-		err = updateLastProcess(incident.IncidentID, models.ProxysqlRestart)
-		return removeReplica(incident)
-	case models.ProxysqlRestart:
-		sendMessages([]byte(fmt.Sprintf("Rolling restart of proxysql \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := reloadProxySql(incident.SqlMasterInstance)
-		if err != nil {
-			return models.Fail, err
+	}
+	// the next loop works on new replicas, so forget about these
+	err = setBatch(incident.IncidentID, nil)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to clear batch: %s", err.Error())
+	}
+	err = clearLastReplica(incident.IncidentID)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to clear last replica: %s", err.Error())
+	}
+	incident.LastReadReplicaName = ""
+	incident.OperationID = ""
+	incident.LastIPAddress = ""
+	return models.DaemonAck, nil
+}
+
+// closeIncident removes the incident from datastore
+func closeIncident(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	_, err := deleteIncident(incident.IncidentID)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to DeleteIncident with error %s", err.Error())
+	}
+	return models.Clear, nil
+}
+
+// selectReplicaForRemoval picks the batch of chester created replicas to
+// remove in this loop and stores it on the incident. If a batch was already
+// picked before a restart, that one is used again.
+func selectReplicaForRemoval(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+	batch, err := getBatch(incident)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
+	}
+	if len(batch) > 0 {
+		return replicaDrain, nil
+	}
+	instances, err := getGroupReplicas(ctx, incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to list replicas for %s: %s", incident.SqlMasterInstance, err.Error())
+	}
+	scaling, err := getScalingPolicy(incident.SqlMasterInstance)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to get scaling policy: %s", err.Error())
+	}
+	size := scaling.StepSize
+	if alertSize := alertStepSize(*incident); alertSize > 0 {
+		size = alertSize
+	}
+	var policy string
+	reasons := []string{}
+	for len(batch) < size {
+		// minimums are checked against what's left after each pick
+		candidates, err := removableReplicas(incident.SqlMasterInstance, instances, scaling.MinReplicas)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to filter replicas for %s: %s", incident.SqlMasterInstance, err.Error())
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		victim, victimPolicy, reason, err := selectVictim(incident.SqlMasterInstance, candidates)
+		if err != nil {
+			return models.Fail, fmt.Errorf("failed to pick a replica to remove: %s", err.Error())
+		}
+		policy = victimPolicy
+		reasons = append(reasons, fmt.Sprintf("%s: %s", victim.Name, reason))
+		batch = append(batch, batchReplica{
+			Name:      victim.Name,
+			Region:    victim.Region,
+			IPAddress: getPrivateIP(victim.IpAddresses),
+		})
+		remaining := []*sqladmin.DatabaseInstance{}
+		for _, instance := range instances {
+			if instance.Name != victim.Name {
+				remaining = append(remaining, instance)
+			}
 		}
-		incident.LastProcess = models.InstanceInsert
-		err = updateLastProcess(incident.IncidentID, models.InstanceInsert)
-		return removeReplica(incident)
-	case models.InstanceInsert:
-		resp, err := deleteDatabaseReplica(incident.LastReadReplicaName)
+		instances = remaining
+	}
+	if len(batch) == 0 {
+		sendMessages([]byte(fmt.Sprintf("Scale down stopped, %d replicas left and every one is needed for a minimum \n IncidentID: %s \n Database: %s \n Project: %s", len(instances), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		return models.Closed, nil
+	}
+	names := strings.Join(batchNames(batch), ", ")
+	_, err = updateIncidentDetails(incident.IncidentID, func(details *incidentDetails) {
+		details.VictimPolicy = policy
+		details.VictimReplica = names
+		details.VictimReason = strings.Join(reasons, "; ")
+	})
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to record picked replicas: %s", err.Error())
+	}
+	sendMessages([]byte(fmt.Sprintf("Picked %s for removal with the %s policy \n reason: %s \n IncidentID: %s \n Database: %s \n Project: %s", names, policy, strings.Join(reasons, "; "), incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	err = setBatch(incident.IncidentID, batch)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to store batch: %s", err.Error())
+	}
+	last := batch[len(batch)-1].Name
+	err = updateLastReadReplica(incident.IncidentID, last)
+	if err != nil {
+		return models.Fail, fmt.Errorf("failed to update last read replica: %s", err.Error())
+	}
+	incident.LastReadReplicaName = last
+	sendMessages([]byte(fmt.Sprintf("Removing instances: %s \n IncidentID: %s \n Database: %s \n Project: %s", names, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	return replicaDrain, nil
+}
+
+// deleteReplica returns a step that asks the sqladmin API to delete every
+// replica in the batch, then moves on to next.
+func deleteReplica(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		batch, err := getBatch(incident)
 		if err != nil {
-			return models.Fail, err
+			return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
 		}
-		incident.OperationID = resp.Name
-		sendMessages([]byte(fmt.Sprintf("Destroying instance operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", incident.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err = updateOperationID(incident.IncidentID, resp.Name)
+		err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+			return deleteBatchReplica(ctx, incident, replica)
+		})
 		if err != nil {
 			return models.Fail, err
 		}
-		incident.LastProcess = models.StatusCheck
-		err = updateLastProcess(incident.IncidentID, models.StatusCheck)
+		return next, nil
+	}
+}
+
+// deleteBatchReplica deletes a replica of the batch and stores the operation
+// on it. Replicas that are already gone, or already being deleted, aren't
+// deleted again.
+func deleteBatchReplica(ctx context.Context, incident *models.DataStoreIncident, replica batchReplica) error {
+	existing, err := findInstance(ctx, replica.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up replica %s: %s", replica.Name, err.Error())
+	}
+	if existing == nil {
+		log.WithField("incident", incident.IncidentID).Infof("replica %s is already deleted", replica.Name)
+		return nil
+	}
+	operationID := replica.OperationID
+	if operationID == "" {
+		operationID, err = findOperation(ctx, replica.Name, "DELETE")
 		if err != nil {
-			return models.Fail, err
+			return fmt.Errorf("failed to find delete operation: %s", err.Error())
 		}
-		return removeReplica(incident)
-	case models.StatusCheck:
-		funclog.Debugf("status check on waiting for operation")
-		sendMessages([]byte(fmt.Sprintf("Waiting for operation: %s \n IncidentID: %s \n Database: %s \n Project: %s", incident.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-		err := waitForOperation(incident.OperationID)
+	}
+	if operationID == "" {
+		resp, err := deleteDatabaseReplica(ctx, masterName(existing), replica.Name)
 		if err != nil {
-			sendMessages([]byte(fmt.Sprintf("Operation Failed \n error: %s \n Operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", err.Error(), incident.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			return models.Fail, err
+			return err
 		}
-		funclog.Debugf("cooldown for removal timer started")
-		status, err := coolDownTimer(incident)
+		operationID = resp.Name
+		sendMessages([]byte(fmt.Sprintf("Destroying instance %s operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.Name, operationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	}
+	return updateBatchReplica(incident.IncidentID, replica.Name, func(replica *batchReplica) {
+		replica.OperationID = operationID
+	})
+}
+
+// waitForReplicaDeletion returns a step that waits on the batch's delete
+// operations to finish, then moves on to next.
+func waitForReplicaDeletion(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		batch, err := getBatch(incident)
 		if err != nil {
-			return models.Fail, err
+			return models.Fail, fmt.Errorf("failed to get batch: %s", err.Error())
 		}
-		if status != models.Closed {
-			sendMessages([]byte(fmt.Sprintf("Cooldown period passed, removing another instance \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			funclog.Debugf("still need to remove replicas")
-			err = updateLastProcess(incident.IncidentID, models.DaemonAck)
-			incident.LastProcess = models.DaemonAck
-			if err != nil {
-				return models.Fail, err
+		err = forEachInBatch(ctx, batch, func(ctx context.Context, replica batchReplica) error {
+			if replica.OperationID == "" {
+				return nil
 			}
-			return removeReplica(incident)
-		} else {
-			sendMessages([]byte(fmt.Sprintf("Removal Incident closed \n IncidentID: %s \n Database: %s \n Project: %s", incident.IncidentID, incident.SqlMasterInstance, projectID)))
-			incident.LastProcess = "closed"
-			err = updateLastProcess(incident.IncidentID, "closed")
+			sendMessages([]byte(fmt.Sprintf("Waiting for operation: %s \n IncidentID: %s \n Database: %s \n Project: %s", replica.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			err := waitForOperation(ctx, replica.OperationID)
 			if err != nil {
-				return models.Fail, err
+				sendMessages([]byte(fmt.Sprintf("Operation Failed \n error: %s \n Operation ID: %s \n IncidentID: %s \n Database: %s \n Project: %s", err.Error(), replica.OperationID, incident.IncidentID, incident.SqlMasterInstance, projectID)))
 			}
-			return removeReplica(incident)
-		}
-	case models.Closed:
-		err := updateLastProcess(incident.IncidentID, "closed")
-		if err != nil {
-			return models.Fail, err
-		}
-		incident.LastProcess = models.Clear
-		_, err = deleteIncident(incident.IncidentID)
+			return err
+		})
 		if err != nil {
 			return models.Fail, err
 		}
-		return removeReplica(incident)
-	default:
-		var err error
-		if lastProcess != models.Clear {
-			err = errors.New(fmt.Sprintf("unknown status %s", lastProcess))
-		}
-		return lastProcess, err
+		return next, nil
 	}
 }
 
 // this doesn't require the update and sturdiness, as of yet, cause these aren't created in datastore
 func restartProxySQL(incident models.DataStoreIncident) (string, error) {
-	err := updateConfigMap(incident.SqlMasterInstance)
+	err := updateConfigMap(incident.SqlMasterInstance, nil)
 	if err != nil {
 		return models.Fail, err
 	}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+// scalingPolicyKind is the per instance group entity with the group's scaling limits
+const scalingPolicyKind string = "chester_scaling_policy"
+
+// scalingPolicy is stored per instance group to limit how far and how fast it
+// scales. It's read on every loop of an incident, so changes apply to running
+// incidents without a redeploy.
+type scalingPolicy struct {
+	// MinReplicas is the number of replicas scale downs stop at, defaults to 0
+	MinReplicas int
+	// MaxReplicas is the number of replicas scale ups stop at, defaults to
+	// MaxChesterInstances from the group's metadata
+	MaxReplicas int
+	// StepSize is the number of replicas added or removed before a cooldown, defaults to 1
+	StepSize int
+	// ScaleUpCooldownSeconds is the wait after a scale up step, defaults to 300
+	ScaleUpCooldownSeconds int
+	// ScaleDownCooldownSeconds is the wait after a scale down step, defaults to 300
+	ScaleDownCooldownSeconds int
+	// MaxIncidentDurationSeconds is how long an incident keeps scaling after
+	// it started before it's closed, zero means no limit
+	MaxIncidentDurationSeconds int
+}
+
+// getScalingPolicy gets the scaling policy for an instance group
+func getScalingPolicy(instanceGroup string) (scalingPolicy, error) {
+	policy := scalingPolicy{
+		StepSize:                 1,
+		ScaleUpCooldownSeconds:   300,
+		ScaleDownCooldownSeconds: 300,
+	}
+	err := getGroupSetting(scalingPolicyKind, instanceGroup, &policy)
+	if err != nil {
+		return policy, err
+	}
+	if policy.MaxReplicas == 0 {
+		chesterMetaData, err := getChesterMetaData(instanceGroup)
+		if err != nil {
+			return policy, err
+		}
+		policy.MaxReplicas = chesterMetaData.MaxChesterInstances
+	}
+	if policy.StepSize < 1 {
+		policy.StepSize = 1
+	}
+	return policy, nil
+}
+
+// cooldown returns the wait after a step of the incident's action
+func (p scalingPolicy) cooldown(action string) time.Duration {
+	if action == "remove" {
+		return time.Duration(p.ScaleDownCooldownSeconds) * time.Second
+	}
+	return time.Duration(p.ScaleUpCooldownSeconds) * time.Second
+}
+
+// expired checks whether the incident has run past the max incident duration
+func (p scalingPolicy) expired(incident models.DataStoreIncident) bool {
+	if p.MaxIncidentDurationSeconds <= 0 {
+		return false
+	}
+	maxDuration := time.Duration(p.MaxIncidentDurationSeconds) * time.Second
+	return time.Since(time.Unix(incident.StartedAt, 0)) > maxDuration
+}
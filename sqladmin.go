@@ -1,92 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	models "github.com/eahrend/chestermodels"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	"net/http"
 	"strings"
 	"time"
 )
 
-// createDatabaseReplica takes a set of configuration values and
+// createDatabaseReplica takes a replica spec and
 // sends a command to the sqladmin api. On a successful call,
 // it will send back a nil error code and a string that contains the
 // operation ID. On an unsuccessful call, it will return a non-nil error
-// and an empty string.
-func createDatabaseReplica(masterInstanceName string, userLabels map[string]string, dbFlags []*sqladmin.DatabaseFlags, region, instanceName string, dataDiskSizeGb int64, tier string) (string, error) {
+// and an empty string. The insert is queued behind other operations on the master.
+func createDatabaseReplica(ctx context.Context, spec replicaSpec) (string, error) {
+	rb := replicaInstance(spec)
+	op, err := scheduleOperation(ctx, spec.MasterInstanceName, []string{spec.MasterInstanceName}, fmt.Sprintf("create replica %s", spec.Name), func() (*sqladmin.Operation, error) {
+		return insertInstance(ctx, rb)
+	})
+	if err != nil {
+		return "", err
+	}
+	return op.Name, nil
+}
+
+// replicaInstance builds the sqladmin.DatabaseInstance that creates the replica in spec
+func replicaInstance(spec replicaSpec) *sqladmin.DatabaseInstance {
 	var resize = true
-	userLabels["chester"] = "true"
 	rb := &sqladmin.DatabaseInstance{
-		Name:               instanceName,
-		MasterInstanceName: masterInstanceName,
-		Region:             region,
+		Name:               spec.Name,
+		MasterInstanceName: spec.MasterInstanceName,
+		Region:             spec.Region,
 		Settings: &sqladmin.Settings{
-			DatabaseFlags: dbFlags,
+			DatabaseFlags: spec.DatabaseFlags,
 			BackupConfiguration: &sqladmin.BackupConfiguration{
 				BinaryLogEnabled: false,
 				Enabled:          false,
 				Kind:             "sql#backupConfiguration",
 				StartTime:        "11:00",
 			},
-			ActivationPolicy:            "ALWAYS",
-			PricingPlan:                 "PACKAGE",
+			ActivationPolicy:            spec.ActivationPolicy,
+			PricingPlan:                 spec.PricingPlan,
 			ReplicationType:             "SYNCHRONOUS",
 			SettingsVersion:             1,
 			DatabaseReplicationEnabled:  true,
 			CrashSafeReplicationEnabled: true,
-			AvailabilityType:            "ZONAL",
-			Tier:                        tier,
+			AvailabilityType:            spec.AvailabilityType,
+			Tier:                        spec.Tier,
 			IpConfiguration: &sqladmin.IpConfiguration{
 				Ipv4Enabled:     false,
 				PrivateNetwork:  fmt.Sprintf("projects/%s/global/networks/%s", networkProjectID, networkName),
 				RequireSsl:      true,
 				ForceSendFields: []string{"Ipv4Enabled"},
 			},
-			DataDiskSizeGb:         dataDiskSizeGb,
-			DataDiskType:           "PD_SSD",
+			DataDiskSizeGb:         spec.DataDiskSizeGb,
+			DataDiskType:           spec.DataDiskType,
 			StorageAutoResize:      &resize,
 			StorageAutoResizeLimit: 0,
 			MaintenanceWindow: &sqladmin.MaintenanceWindow{
-				Day:  0,
-				Hour: 0,
+				Day:  spec.MaintenanceWindowDay,
+				Hour: spec.MaintenanceWindowHour,
 				Kind: "sql#maintenanceWindow",
 			},
-			UserLabels: userLabels,
+			UserLabels: spec.UserLabels,
 		},
 	}
-	retryCount := 0
-	resp, err := sqlAdminSvc.Instances.Insert(projectID, rb).Context(ctx).Do()
-	for retryCount < 120 {
-		log.Debugln("Running Retry # ", retryCount)
-		if err != nil {
-			log.Errorf("error from inserting:", err.Error())
-		}
-		if resp == nil || resp.HTTPStatusCode == 409 {
-			log.Debugln("Response was either 409 or nil")
-			log.Debugln("HTTP Status Code:", resp.HTTPStatusCode)
-			respb, _ := resp.MarshalJSON()
-			log.Debugln("Response Body, if nil we'll get a panic:", string(respb))
-			retryCount++
-			time.Sleep(time.Second * 30)
-			continue
-		} else if resp.HTTPStatusCode == 200 {
-			log.Debugln("Received 200 status code")
-			break
-		} else {
-			return "", err
+	if spec.Zone != "" {
+		rb.Settings.LocationPreference = &sqladmin.LocationPreference{
+			Zone: spec.Zone,
+			Kind: "sql#locationPreference",
 		}
 	}
+	return rb
+}
 
-	return resp.Name, err
+// insertInstance asks the sqladmin api to create an instance, without queueing
+func insertInstance(ctx context.Context, rb *sqladmin.DatabaseInstance) (*sqladmin.Operation, error) {
+	var op *sqladmin.Operation
+	err := callSQLAdminMutation(ctx, "instances.insert", func(ctx context.Context) error {
+		var err error
+		op, err = sqlAdminSvc.Instances.Insert(projectID, rb).Context(ctx).Do()
+		return err
+	})
+	return op, err
 }
 
 // getInstance gets a sqladmin.DatabaseInstance object based on the name of the instance.
 // On a successful call, it will return a pointer to a sqladmin.DatabaseInstance and a nil error.
 // On an unsuccessful call, it will return a nil object and a non-nil error.
-func getInstance(name string) (*sqladmin.DatabaseInstance, error) {
+func getInstance(ctx context.Context, name string) (*sqladmin.DatabaseInstance, error) {
 	log.Debugf("Getting Instance Data \n Project ID: %s \n Instance Name: %s", projectID, name)
-	resp, err := sqlAdminSvc.Instances.Get(projectID, name).Context(ctx).Do()
+	var resp *sqladmin.DatabaseInstance
+	err := callSQLAdmin(ctx, "instances.get", func(ctx context.Context) error {
+		var err error
+		resp, err = sqlAdminSvc.Instances.Get(projectID, name).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("Failed to find instance: %s", name))
 		return nil, err
@@ -94,17 +107,82 @@ func getInstance(name string) (*sqladmin.DatabaseInstance, error) {
 	return resp, err
 }
 
+// isNotFound checks whether an error from the sqladmin api is a 404
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// findInstance gets an instance if it exists. A missing instance is not an error,
+// it returns a nil instance instead.
+func findInstance(ctx context.Context, name string) (*sqladmin.DatabaseInstance, error) {
+	var resp *sqladmin.DatabaseInstance
+	err := callSQLAdmin(ctx, "instances.get", func(ctx context.Context) error {
+		var err error
+		resp, err = sqlAdminSvc.Instances.Get(projectID, name).Context(ctx).Do()
+		return err
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return resp, err
+}
+
+// findOperation returns the name of the most recent operation of operationType
+// on an instance, or an empty string if there isn't one. This is used to pick up
+// operations that were started before the daemon had a chance to record them.
+func findOperation(ctx context.Context, instanceName, operationType string) (string, error) {
+	var resp *sqladmin.OperationsListResponse
+	err := callSQLAdmin(ctx, "operations.list", func(ctx context.Context) error {
+		var err error
+		resp, err = sqlAdminSvc.Operations.List(projectID).Instance(instanceName).Context(ctx).Do()
+		return err
+	})
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// operations are listed most recent first
+	for _, op := range resp.Items {
+		if op.OperationType == operationType {
+			return op.Name, nil
+		}
+	}
+	return "", nil
+}
+
 // waitForOperation takes an operation ID and gets the status of it.
-// This will poll until a non-nil error is returned from opSvc.Get
-// or a DONE status is returned.
+// This will poll until a non-nil error is returned from opSvc.Get,
+// a DONE status is returned or the context is done. The wait is cut off
+// once the operation has run longer than the max duration for its type,
+// and stopped if the incident in ctx is closed or superseded. Either way
+// the cloud sql operation itself carries on.
 // If opSvc.Get returns a non-nil error, this will return a non-nil error.
-func waitForOperation(opName string) error {
+func waitForOperation(ctx context.Context, opName string) error {
 	opSvc := *sqladmin.NewOperationsService(sqlAdminSvc)
+	var (
+		deadline   time.Time
+		max        time.Duration
+		lastReport time.Time
+	)
 	for {
-		result, err := opSvc.Get(projectID, opName).Do()
+		var result *sqladmin.Operation
+		err := callSQLAdmin(ctx, "operations.get", func(ctx context.Context) error {
+			var err error
+			result, err = opSvc.Get(projectID, opName).Context(ctx).Do()
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("Failed retriving operation status: %s", err)
 		}
+		if deadline.IsZero() {
+			// the limit runs from when cloud sql queued the operation, so
+			// resuming after a restart doesn't start the clock again
+			max = operationMaxDuration(result.OperationType)
+			deadline = operationStarted(result).Add(max)
+		}
 		log.Debugln("Result status:", result.Status)
 		switch resultStatus := result.Status; resultStatus {
 		case "DONE":
@@ -117,93 +195,110 @@ func waitForOperation(opName string) error {
 			}
 			return nil
 		default:
-			resultJSON, err := result.MarshalJSON()
-			if err != nil {
-				return fmt.Errorf("received error from marshalling result: %s", err.Error())
+			elapsed := time.Since(operationStarted(result))
+			log.WithFields(log.Fields{
+				"operation": opName,
+				"type":      result.OperationType,
+				"target":    result.TargetId,
+				"elapsed":   elapsed.Round(time.Second),
+				"max":       max,
+			}).Infof("operation is %s", result.Status)
+			if time.Since(lastReport) >= operationProgressInterval {
+				lastReport = time.Now()
+				recordOperationProgress(ctx, result, elapsed, max)
+				if err := checkIncidentCurrent(ctx); err != nil {
+					return fmt.Errorf("stopped waiting on operation %s: %w", opName, err)
+				}
 			}
-			log.Infoln(string(resultJSON))
 		}
-		time.Sleep(5 * time.Second)
+		if time.Now().After(deadline) {
+			// retrying won't help, the limit is measured from the operation's start
+			return permanent(fmt.Errorf("%s operation %s has run longer than its max of %s", result.OperationType, opName, max))
+		}
+		select {
+		case <-time.After(operationPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting on operation %s: %w", opName, ctx.Err())
+		}
 	}
 }
 
-// getInstances returns a list of models.DatabaseHost structs based
-// on a search and filter string.
-// TODO: Remove the log.Fatal and return an error
-func getInstances(search string, filter string) []models.DatabaseHost {
-	dbHosts := make([]models.DatabaseHost, 0, 100)
-	var (
-		publicIPAddress  string
-		privateIPAddress string
-		req              *sqladmin.InstancesListCall
-	)
-	if filter != "" {
-		req = sqlAdminSvc.Instances.List(projectID).Filter(filter)
-	} else {
-		req = sqlAdminSvc.Instances.List(projectID)
+// getGroupReplicas returns the chester created replicas that belong to an
+// instance group and are in use, leaving out pooled replicas.
+func getGroupReplicas(ctx context.Context, instanceGroup string) ([]*sqladmin.DatabaseInstance, error) {
+	replicas, err := listChesterReplicas(ctx, instanceGroup)
+	if err != nil {
+		return nil, err
 	}
-	if err := req.Pages(ctx, func(page *sqladmin.InstancesListResponse) error {
-		for _, databaseInstance := range page.Items {
-			if search != "" {
-				sc := strings.Contains(databaseInstance.Name, search)
-				if sc {
-					for _, ipaddress := range databaseInstance.IpAddresses {
-						if ipaddress.Type == "PRIMARY" {
-							publicIPAddress = ipaddress.IpAddress
-						}
-						if ipaddress.Type == "PRIVATE" {
-							privateIPAddress = ipaddress.IpAddress
-						}
-					}
-					dbHosts = append(dbHosts, models.DatabaseHost{databaseInstance.Name, privateIPAddress, publicIPAddress})
-				}
-			}
-			if filter != "" {
-				for _, ipaddress := range databaseInstance.IpAddresses {
-					if ipaddress.Type == "PRIMARY" {
-						publicIPAddress = ipaddress.IpAddress
-					}
-					if ipaddress.Type == "PRIVATE" {
-						privateIPAddress = ipaddress.IpAddress
-					}
+	inUse := []*sqladmin.DatabaseInstance{}
+	for _, replica := range replicas {
+		if poolState(replica) == "" {
+			inUse = append(inUse, replica)
+		}
+	}
+	return inUse, nil
+}
+
+// listChesterReplicas returns every chester created replica that belongs to
+// an instance group, pooled or not. Replicas are matched on the chester_group
+// label, replicas created before the label existed are matched on their master instance.
+func listChesterReplicas(ctx context.Context, instanceGroup string) ([]*sqladmin.DatabaseInstance, error) {
+	var replicas []*sqladmin.DatabaseInstance
+	req := sqlAdminSvc.Instances.List(projectID).Filter("settings.userLabels.chester:true")
+	err := callSQLAdmin(ctx, "instances.list", func(ctx context.Context) error {
+		// a retry starts again from the first page
+		replicas = nil
+		return req.Pages(ctx, func(page *sqladmin.InstancesListResponse) error {
+			for _, databaseInstance := range page.Items {
+				if replicaInGroup(databaseInstance, instanceGroup) {
+					replicas = append(replicas, databaseInstance)
 				}
-				dbHosts = append(dbHosts, models.DatabaseHost{databaseInstance.Name, privateIPAddress, publicIPAddress})
 			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+// replicaInGroup checks whether a chester replica belongs to an instance group.
+// The label holds the group as a label value, which may be cut short, so the
+// group is compared the same way.
+func replicaInGroup(instance *sqladmin.DatabaseInstance, instanceGroup string) bool {
+	if instance.Settings != nil {
+		if group, ok := instance.Settings.UserLabels[groupLabel]; ok {
+			return group == labelValue(instanceGroup)
 		}
-		return nil
-	}); err != nil {
-		log.Fatal(err)
 	}
-	return dbHosts
+	return masterName(instance) == instanceGroup
 }
 
-// deleteDatabaseReplica removes a read replica based on the named of the
-// read replica.
+// deleteDatabaseReplica removes a read replica of master based on the name of the
+// read replica. The delete is queued behind other operations on the master and
+// the replica.
 // On a successful call it will return a pointer to a sqladmin.Operation struct
 // and a nil error.
 // On an unsuccessful call it will return a nil object and a non-nil error.
-// TODO: rename function parameter 'identifier' to something like
-//   instance name
-func deleteDatabaseReplica(identifier string) (*sqladmin.Operation, error) {
-	resp, err := sqlAdminSvc.Instances.Delete(projectID, identifier).Context(ctx).Do()
-	retryCount := 0
-	for retryCount < 120 {
-		if err != nil && resp.HTTPStatusCode == 409 {
-			log.Errorln("Received 409", err)
-			retryCount++
-			time.Sleep(time.Second * 30)
-			continue
-		} else if resp.HTTPStatusCode == 200 {
-			log.Debugln("Deleted Database after retries:", retryCount)
-			return resp, nil
-		} else {
-			log.Errorln("Unknown Error after retry:", err)
-			return nil, err
-		}
-	}
+func deleteDatabaseReplica(ctx context.Context, master, instanceName string) (*sqladmin.Operation, error) {
+	op, err := scheduleOperation(ctx, master, []string{master, instanceName}, fmt.Sprintf("delete replica %s", instanceName), func() (*sqladmin.Operation, error) {
+		return deleteInstance(ctx, instanceName)
+	})
 	if err != nil {
 		log.Errorln("Deleting Database Replica Error:", err)
 		return nil, err
 	}
-	return resp, err
+	return op, nil
+}
+
+// deleteInstance asks the sqladmin api to delete an instance, without queueing
+func deleteInstance(ctx context.Context, instanceName string) (*sqladmin.Operation, error) {
+	var op *sqladmin.Operation
+	err := callSQLAdminMutation(ctx, "instances.delete", func(ctx context.Context) error {
+		var err error
+		op, err = sqlAdminSvc.Instances.Delete(projectID, instanceName).Context(ctx).Do()
+		return err
+	})
+	return op, err
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// errClassConflict is a 409, another operation is running on the instance
+	errClassConflict string = "conflict"
+	// errClassQuota is a 429, or a 403 for a rate limit or quota
+	errClassQuota string = "quota"
+	// errClassServer is a 5xx
+	errClassServer string = "server"
+	// errClassNotFound is a 404
+	errClassNotFound string = "not_found"
+	// errClassTransport is a network error or a call that hit its own deadline
+	errClassTransport string = "transport"
+	// errClassCanceled means the caller's context is done
+	errClassCanceled string = "canceled"
+	// errClassClient is any other 4xx, retrying won't help
+	errClassClient string = "client"
+)
+
+// sqlAdminCallTimeout is the deadline of a single attempt at a sqladmin call
+var sqlAdminCallTimeout time.Duration
+
+// sqlAdminMaxRetries is the number of extra attempts made at a sqladmin call
+var sqlAdminMaxRetries int
+
+// sqlAdminBackoffBase is the wait before the first retry, it doubles each retry
+var sqlAdminBackoffBase = time.Second
+
+// sqlAdminBackoffMax caps the wait between retries
+var sqlAdminBackoffMax = time.Minute
+
+// incidentKey is the context key holding the incident a call is made for
+type incidentKey struct{}
+
+// incidentRef identifies the incident and step a context was made for
+type incidentRef struct {
+	// ID is the incident ID
+	ID string
+	// Process is the LastProcess of the step being run
+	Process string
+	// Closing means the step is winding the incident down, so it carries on
+	// once the incident is closed
+	Closing bool
+}
+
+// withIncident returns a context that records sqladmin retries and operation
+// progress against the incident, made for the step handling process
+func withIncident(ctx context.Context, incidentID, process string, closing bool) context.Context {
+	return context.WithValue(ctx, incidentKey{}, incidentRef{ID: incidentID, Process: process, Closing: closing})
+}
+
+// incidentFromContext returns the incident set by withIncident, if any
+func incidentFromContext(ctx context.Context) incidentRef {
+	ref, _ := ctx.Value(incidentKey{}).(incidentRef)
+	return ref
+}
+
+// classifyError sorts an error from a sqladmin call. ctx is the caller's
+// context, so a call that hit its own deadline isn't mistaken for the caller
+// giving up.
+func classifyError(ctx context.Context, err error) string {
+	if ctx.Err() != nil {
+		return errClassCanceled
+	}
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return errClassTransport
+	}
+	switch {
+	case gerr.Code == http.StatusConflict:
+		return errClassConflict
+	case gerr.Code == http.StatusNotFound:
+		return errClassNotFound
+	case gerr.Code == http.StatusTooManyRequests:
+		return errClassQuota
+	case gerr.Code == http.StatusForbidden:
+		for _, item := range gerr.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+				return errClassQuota
+			}
+		}
+		return errClassClient
+	case gerr.Code >= 500:
+		return errClassServer
+	}
+	return errClassClient
+}
+
+// backoff returns the wait before retry number attempt, exponential with full jitter
+func backoff(attempt int) time.Duration {
+	wait := sqlAdminBackoffMax
+	if attempt < 16 {
+		if d := sqlAdminBackoffBase << uint(attempt); d < wait {
+			wait = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(wait) + 1))
+}
+
+// callSQLAdmin makes a read only sqladmin call, retrying quota, server and
+// transport errors with backoff. Each attempt gets its own deadline of
+// sqlAdminCallTimeout within ctx.
+func callSQLAdmin(ctx context.Context, call string, fn func(ctx context.Context) error) error {
+	return retrySQLAdmin(ctx, call, fn, func(class string) bool {
+		return class == errClassQuota || class == errClassServer || class == errClassTransport
+	})
+}
+
+// callSQLAdminMutation makes a sqladmin call that changes something. Only
+// quota errors are retried, since the request was turned away before it ran,
+// a server or transport error may have started the operation anyway and the
+// calling step checks for that before trying again.
+func callSQLAdminMutation(ctx context.Context, call string, fn func(ctx context.Context) error) error {
+	return retrySQLAdmin(ctx, call, fn, func(class string) bool {
+		return class == errClassQuota
+	})
+}
+
+// retrySQLAdmin runs fn until it succeeds, fails with an error retry doesn't
+// accept, runs out of retries or ctx is done. Retries are recorded on the
+// incident in ctx.
+func retrySQLAdmin(ctx context.Context, call string, fn func(ctx context.Context) error, retry func(class string) bool) error {
+	funclog := log.WithFields(log.Fields{
+		"func":     "retrySQLAdmin",
+		"call":     call,
+		"incident": incidentFromContext(ctx).ID,
+	})
+	var err error
+	attempt := 0
+	for ; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, sqlAdminCallTimeout)
+		err = fn(callCtx)
+		cancel()
+		if err == nil {
+			break
+		}
+		class := classifyError(ctx, err)
+		if !retry(class) || attempt >= sqlAdminMaxRetries {
+			err = fmt.Errorf("%s failed (%s) after %d retries: %w", call, class, attempt, err)
+			break
+		}
+		wait := backoff(attempt)
+		funclog.Warnf("attempt %d failed (%s), retrying in %s: %s", attempt+1, class, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			err = fmt.Errorf("%s stopped retrying after %d retries: %s: %w", call, attempt, ctx.Err(), err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if attempt > 0 {
+		recordSQLAdminRetries(ctx, call, attempt, err)
+	}
+	return err
+}
+
+// recordSQLAdminRetries adds the retries of a call to the incident in ctx.
+// Failing to record them is logged, it doesn't fail the call.
+func recordSQLAdminRetries(ctx context.Context, call string, retries int, err error) {
+	id := incidentFromContext(ctx).ID
+	if id == "" {
+		return
+	}
+	_, uerr := updateIncidentDetails(id, func(details *incidentDetails) {
+		details.SQLAdminRetries += retries
+		details.LastSQLAdminRetry = fmt.Sprintf("%s retried %d times", call, retries)
+		if err != nil {
+			details.LastSQLAdminRetry = fmt.Sprintf("%s, last error: %s", details.LastSQLAdminRetry, err.Error())
+		}
+	})
+	if uerr != nil {
+		log.WithField("incident", id).Warnf("failed to record sqladmin retries: %s", uerr.Error())
+	}
+}
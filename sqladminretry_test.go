@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	reason := func(code int, reason string) error {
+		return &googleapi.Error{Code: code, Errors: []googleapi.ErrorItem{{Reason: reason}}}
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{name: "conflict", err: &googleapi.Error{Code: http.StatusConflict}, want: errClassConflict},
+		{name: "not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: errClassNotFound},
+		{name: "too many requests", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: errClassQuota},
+		{name: "rate limit", err: reason(http.StatusForbidden, "rateLimitExceeded"), want: errClassQuota},
+		{name: "quota", err: reason(http.StatusForbidden, "quotaExceeded"), want: errClassQuota},
+		{name: "forbidden", err: reason(http.StatusForbidden, "forbidden"), want: errClassClient},
+		{name: "server", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: errClassServer},
+		{name: "bad request", err: &googleapi.Error{Code: http.StatusBadRequest}, want: errClassClient},
+		{name: "wrapped", err: fmt.Errorf("insert: %w", &googleapi.Error{Code: http.StatusConflict}), want: errClassConflict},
+		{name: "transport", err: fmt.Errorf("connection reset by peer"), want: errClassTransport},
+		{name: "call deadline", err: context.DeadlineExceeded, want: errClassTransport},
+		{name: "caller cancelled", ctx: cancelled, err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: errClassCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := classifyError(ctx, tt.err); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,7 +12,14 @@ import (
 
 // startup gets a list of active and closed incidents
 // as well as older incidents that may have not been resolved.
+// Open incidents, and any incident in progress, are republished so they resume
+// from their persisted LastProcess.
 func startup() error {
+	err := clearStaleLeases()
+	if err != nil {
+		log.Errorf("failed to clear stale leases: %s", err)
+		return err
+	}
 	closedQuery := datastore.NewQuery("incident").Namespace("chester").Filter("State=", "closed")
 	closedIterator := datastoreClient.Run(ctx, closedQuery)
 	closedIncidents, err := getDataStoreIncidents(closedIterator)
@@ -50,16 +57,39 @@ func startup() error {
 	return nil
 }
 
-// getExpiredIncidents combines the explicitly closed incidents with the expired incidents
+// getExpiredIncidents splits the incidents into those to rerun and those to
+// delete. Incidents the daemon has started working on are always rerun, even
+// closed or old ones, so their steps can finish or roll back what they
+// created. Only incidents that were never picked up are deleted once they're
+// closed or older than 3 hours. Dead lettered incidents are left alone.
 func getExpiredIncidents(incidents []models.DataStoreIncident, closedIncidents []models.DataStoreIncident) ([]models.DataStoreIncident, []models.DataStoreIncident) {
-	for k, incident := range incidents {
-		openTime := time.Unix(incident.StartedAt, 0)
-		nowTime := time.Now()
-		diff := nowTime.Sub(openTime)
-		if diff > 3*time.Hour {
-			closedIncidents = append(closedIncidents, incident)
-			incidents = append(incidents[:k], incidents[k+1:]...)
+	toRun := []models.DataStoreIncident{}
+	toClose := []models.DataStoreIncident{}
+	for _, incident := range incidents {
+		if incident.LastProcess == deadLettered {
+			continue
+		}
+		if incidentStarted(incident) || time.Since(time.Unix(incident.StartedAt, 0)) <= 3*time.Hour {
+			toRun = append(toRun, incident)
+		} else {
+			toClose = append(toClose, incident)
 		}
 	}
-	return incidents, closedIncidents
+	for _, incident := range closedIncidents {
+		if incident.LastProcess == deadLettered {
+			continue
+		}
+		if incidentStarted(incident) {
+			toRun = append(toRun, incident)
+		} else {
+			toClose = append(toClose, incident)
+		}
+	}
+	return toRun, toClose
+}
+
+// incidentStarted checks whether the daemon has moved an incident past GCFPush
+// and it hasn't finished
+func incidentStarted(incident models.DataStoreIncident) bool {
+	return incident.LastProcess != "" && incident.LastProcess != models.GCFPush && incident.LastProcess != models.Clear
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+func TestGetExpiredIncidents(t *testing.T) {
+	recent := time.Now().Unix()
+	old := time.Now().Add(-4 * time.Hour).Unix()
+	open := []models.DataStoreIncident{
+		{IncidentID: "new", LastProcess: models.GCFPush, StartedAt: recent},
+		{IncidentID: "stale", LastProcess: models.GCFPush, StartedAt: old},
+		{IncidentID: "old-mid-create", LastProcess: models.InstanceInsert, StartedAt: old},
+		{IncidentID: "mid-create", LastProcess: models.InstanceInsert, StartedAt: recent},
+		{IncidentID: "dead-lettered", LastProcess: deadLettered, StartedAt: old},
+	}
+	closed := []models.DataStoreIncident{
+		{IncidentID: "closed-unstarted", LastProcess: models.GCFPush, State: models.Closed, StartedAt: recent},
+		{IncidentID: "closed-mid-rollback", LastProcess: rollbackReplica, State: models.Closed, StartedAt: old},
+		{IncidentID: "closed-clear", LastProcess: models.Clear, State: models.Closed, StartedAt: recent},
+		{IncidentID: "closed-dead-lettered", LastProcess: deadLettered, State: models.Closed, StartedAt: recent},
+	}
+	toRun, toClose := getExpiredIncidents(open, closed)
+	ids := func(incidents []models.DataStoreIncident) []string {
+		ids := []string{}
+		for _, incident := range incidents {
+			ids = append(ids, incident.IncidentID)
+		}
+		return ids
+	}
+	wantRun := []string{"new", "old-mid-create", "mid-create", "closed-mid-rollback"}
+	wantClose := []string{"stale", "closed-unstarted", "closed-clear"}
+	if !equalStrings(ids(toRun), wantRun) {
+		t.Errorf("rerun %v, want %v", ids(toRun), wantRun)
+	}
+	if !equalStrings(ids(toClose), wantClose) {
+		t.Errorf("deleted %v, want %v", ids(toClose), wantClose)
+	}
+}
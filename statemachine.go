@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// stepFunc runs a single step of an incident workflow. It returns the
+// LastProcess value the incident should move to once the step succeeds.
+type stepFunc func(ctx context.Context, incident *models.DataStoreIncident) (string, error)
+
+// step is a single registered stage of a stateMachine, keyed by the
+// LastProcess value that triggers it.
+type step struct {
+	// name is the LastProcess value that this step handles
+	name string
+	// run does the work for this step
+	run stepFunc
+	// next is the list of LastProcess values this step may move to
+	next []string
+	// timeout is the maximum duration of a single attempt, zero means no limit
+	timeout time.Duration
+	// retries is the number of extra attempts made after a failed run,
+	// only set this on steps that are safe to repeat
+	retries int
+	// retryDelay is how long to wait between attempts
+	retryDelay time.Duration
+	// compensate is the LastProcess to move to if the step fails for good,
+	// used to undo completed work. Empty means the incident just fails.
+	compensate string
+}
+
+// allows checks whether the step is permitted to move to the next process
+func (s step) allows(next string) bool {
+	for _, n := range s.next {
+		if n == next {
+			return true
+		}
+	}
+	return false
+}
+
+// stateMachine drives an incident from its persisted LastProcess
+// through registered steps until it reaches models.Clear.
+type stateMachine struct {
+	// name is used for logging
+	name string
+	// steps maps a LastProcess value to the step that handles it
+	steps map[string]step
+	// closeTo is the LastProcess an incident moves to once it's found closed,
+	// empty means a closed incident fails the step like any other error
+	closeTo string
+	// persist stores the LastProcess an incident moved to
+	persist func(incidentID, process string) error
+	// compensated records the step that failed and why before compensating
+	compensated func(incidentID, process, reason string) error
+	// notify sends a message to slack
+	notify func(msg []byte) error
+}
+
+// newStateMachine creates an empty state machine that persists to datastore
+// and notifies slack
+func newStateMachine(name string) *stateMachine {
+	return &stateMachine{
+		name:        name,
+		steps:       map[string]step{},
+		persist:     updateLastProcess,
+		compensated: recordCompensation,
+		notify:      sendMessages,
+	}
+}
+
+// recordCompensation stores the failed step and why on the incident's details
+func recordCompensation(incidentID, process, reason string) error {
+	_, err := updateIncidentDetails(incidentID, func(details *incidentDetails) {
+		details.CompensatedStep = process
+		details.CompensationReason = reason
+	})
+	return err
+}
+
+// register adds a step to the state machine. Registering the same
+// LastProcess twice is a programming error, so this panics.
+func (sm *stateMachine) register(s step) *stateMachine {
+	if _, ok := sm.steps[s.name]; ok {
+		panic(fmt.Sprintf("step %s already registered on state machine %s", s.name, sm.name))
+	}
+	sm.steps[s.name] = s
+	return sm
+}
+
+// onClose sets the LastProcess incidents move to once they're found closed
+func (sm *stateMachine) onClose(process string) *stateMachine {
+	sm.closeTo = process
+	return sm
+}
+
+// closing checks whether process is on the path from closeTo to models.Clear,
+// where a closed incident is being wound down rather than worked on
+func (sm *stateMachine) closing(process string) bool {
+	if sm.closeTo == "" {
+		return false
+	}
+	seen := map[string]bool{}
+	queue := []string{sm.closeTo}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p == process {
+			return true
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		queue = append(queue, sm.steps[p].next...)
+	}
+	return false
+}
+
+// transition checks whether moving from one process to another is allowed
+// without running anything.
+func (sm *stateMachine) transition(from, to string) error {
+	s, ok := sm.steps[from]
+	if !ok {
+		return fmt.Errorf("unknown status %s", from)
+	}
+	if !s.allows(to) {
+		return fmt.Errorf("state machine %s does not allow %s -> %s", sm.name, from, to)
+	}
+	return nil
+}
+
+// run processes the incident step by step, persisting the LastProcess
+// after every successful transition so a restart picks up where it left off.
+// Cancelling the context stops the incident before the next step starts.
+// An incident found closed moves to closeTo, unless it's already on its way
+// to models.Clear, and one found superseded stops without touching it.
+func (sm *stateMachine) run(ctx context.Context, incident models.DataStoreIncident) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":     "stateMachine.run",
+		"machine":  sm.name,
+		"incident": incident.IncidentID,
+	})
+	// an incident closed before it was picked up has nothing to wind down, once
+	// it's under way its steps notice the close and move it to closeTo
+	if incident.State == models.Closed && (sm.closeTo == "" || incident.LastProcess == models.GCFPush) {
+		funclog.Debugf("received closed state from GCF")
+		return "", nil
+	}
+	for {
+		lastProcess := incident.LastProcess
+		if lastProcess == models.Clear {
+			return models.Clear, nil
+		}
+		s, ok := sm.steps[lastProcess]
+		if !ok {
+			return lastProcess, permanent(fmt.Errorf("unknown status %s", lastProcess))
+		}
+		if err := ctx.Err(); err != nil {
+			funclog.WithField("lastProcess", lastProcess).Warnf("stopping incident: %s", err.Error())
+			return lastProcess, err
+		}
+		next, err := sm.runStep(ctx, s, &incident)
+		if errors.Is(err, errIncidentSuperseded) {
+			funclog.WithField("lastProcess", lastProcess).Warnf("stopping incident: %s", err.Error())
+			return lastProcess, nil
+		}
+		compensate := s.compensate
+		if errors.Is(err, errIncidentClosed) && sm.closeTo != "" && !sm.closing(lastProcess) {
+			funclog.WithField("lastProcess", lastProcess).Warnf("moving to %s: %s", sm.closeTo, err.Error())
+			sm.notify([]byte(fmt.Sprintf("Incident closed during %s, moving to %s \n IncidentID: %s \n Database: %s \n Project: %s", lastProcess, sm.closeTo, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+			compensate = sm.closeTo
+		}
+		// a cancelled context means we're shutting down or lost the lease,
+		// which is resumed later rather than compensated
+		if err != nil && (compensate == "" || ctx.Err() != nil) {
+			funclog.WithField("lastProcess", lastProcess).Errorf("step failed with error %s", err.Error())
+			return models.Fail, err
+		}
+		if stepErr := err; stepErr != nil {
+			funclog.WithField("lastProcess", lastProcess).Errorf("step failed with error %s, compensating with %s", stepErr.Error(), compensate)
+			err = sm.compensated(incident.IncidentID, lastProcess, stepErr.Error())
+			if err != nil {
+				return models.Fail, fmt.Errorf("failed to record compensation: %s", err.Error())
+			}
+			next = compensate
+		} else if err = sm.transition(lastProcess, next); err != nil {
+			funclog.WithField("lastProcess", lastProcess).Error(err)
+			return models.Fail, permanent(err)
+		}
+		// the incident no longer exists once it has been cleared
+		if next != models.Clear {
+			err = sm.persist(incident.IncidentID, next)
+			if err != nil {
+				funclog.WithField("lastProcess", lastProcess).Errorf("failed to UpdateLastProcess with error %s", err.Error())
+				return models.Fail, err
+			}
+		}
+		incident.LastProcess = next
+	}
+}
+
+// runStep runs a single step, applying its timeout and retry policy
+func (sm *stateMachine) runStep(ctx context.Context, s step, incident *models.DataStoreIncident) (string, error) {
+	funclog := log.WithFields(log.Fields{
+		"func":        "stateMachine.runStep",
+		"machine":     sm.name,
+		"incident":    incident.IncidentID,
+		"lastProcess": s.name,
+	})
+	ctx = withIncident(ctx, incident.IncidentID, s.name, sm.closing(s.name))
+	for attempt := 0; ; attempt++ {
+		var stepCtx context.Context
+		var cancel context.CancelFunc
+		if s.timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		} else {
+			stepCtx, cancel = context.WithCancel(ctx)
+		}
+		next, err := s.run(stepCtx, incident)
+		cancel()
+		if err == nil {
+			return next, nil
+		}
+		if attempt >= s.retries || isPermanent(err) {
+			return models.Fail, err
+		}
+		funclog.Warnf("attempt %d failed with error %s, retrying in %s", attempt+1, err.Error(), s.retryDelay)
+		select {
+		case <-time.After(s.retryDelay):
+		case <-ctx.Done():
+			return models.Fail, err
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+// recorder stands in for datastore and slack in state machine tests
+type recorder struct {
+	persisted   []string
+	compensated []string
+	messages    int
+	persistErr  error
+}
+
+// testMachine returns a state machine that records to r instead of datastore and slack
+func testMachine(r *recorder, steps ...step) *stateMachine {
+	sm := newStateMachine("test")
+	sm.persist = func(incidentID, process string) error {
+		if r.persistErr != nil {
+			return r.persistErr
+		}
+		r.persisted = append(r.persisted, process)
+		return nil
+	}
+	sm.compensated = func(incidentID, process, reason string) error {
+		r.compensated = append(r.compensated, process)
+		return nil
+	}
+	sm.notify = func(msg []byte) error {
+		r.messages++
+		return nil
+	}
+	for _, s := range steps {
+		sm.register(s)
+	}
+	return sm
+}
+
+// moveTo returns a step func that succeeds and moves to next
+func moveTo(next string) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		return next, nil
+	}
+}
+
+// failWith returns a step func that always fails with err
+func failWith(err error) stepFunc {
+	return func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		return models.Fail, err
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStateMachineTransitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []step
+		want      string
+		wantErr   bool
+		permanent bool
+		persisted []string
+	}{
+		{
+			name: "allowed transitions run to clear",
+			steps: []step{
+				{name: "a", run: moveTo("b"), next: []string{"b"}},
+				{name: "b", run: moveTo(models.Clear), next: []string{models.Clear}},
+			},
+			want:      models.Clear,
+			persisted: []string{"b"},
+		},
+		{
+			name: "denied transition fails for good",
+			steps: []step{
+				{name: "a", run: moveTo("c"), next: []string{"b"}},
+				{name: "b", run: moveTo(models.Clear), next: []string{models.Clear}},
+				{name: "c", run: moveTo(models.Clear), next: []string{models.Clear}},
+			},
+			want:      models.Fail,
+			wantErr:   true,
+			permanent: true,
+		},
+		{
+			name: "unknown status fails for good",
+			steps: []step{
+				{name: "a", run: moveTo("b"), next: []string{"b"}},
+			},
+			want:      "b",
+			wantErr:   true,
+			permanent: true,
+			persisted: []string{"b"},
+		},
+		{
+			name: "failed step without compensation fails",
+			steps: []step{
+				{name: "a", run: failWith(fmt.Errorf("boom")), next: []string{models.Clear}},
+			},
+			want:    models.Fail,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			sm := testMachine(r, tt.steps...)
+			got, err := sm.run(context.Background(), models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && isPermanent(err) != tt.permanent {
+				t.Errorf("got permanent %v, want %v", isPermanent(err), tt.permanent)
+			}
+			if !equalStrings(r.persisted, tt.persisted) {
+				t.Errorf("persisted %v, want %v", r.persisted, tt.persisted)
+			}
+		})
+	}
+}
+
+func TestStateMachineTransition(t *testing.T) {
+	sm := testMachine(&recorder{}, step{name: "a", next: []string{"b"}})
+	if err := sm.transition("a", "b"); err != nil {
+		t.Errorf("a -> b: %s", err)
+	}
+	if err := sm.transition("a", "c"); err == nil {
+		t.Errorf("a -> c: want an error")
+	}
+	if err := sm.transition("x", "b"); err == nil {
+		t.Errorf("x -> b: want an error")
+	}
+}
+
+func TestStateMachineRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		err      error
+		want     string
+		attempts int
+	}{
+		{name: "retried until it succeeds", retries: 2, failures: 2, err: fmt.Errorf("flaky"), want: models.Clear, attempts: 3},
+		{name: "out of retries", retries: 1, failures: 2, err: fmt.Errorf("flaky"), want: models.Fail, attempts: 2},
+		{name: "permanent errors aren't retried", retries: 2, failures: 1, err: permanent(fmt.Errorf("broken")), want: models.Fail, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			run := func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return models.Fail, tt.err
+				}
+				return models.Clear, nil
+			}
+			sm := testMachine(&recorder{}, step{name: "a", run: run, next: []string{models.Clear}, retries: tt.retries})
+			got, _ := sm.run(context.Background(), models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestStateMachineCompensation(t *testing.T) {
+	r := &recorder{}
+	sm := testMachine(r,
+		step{name: "a", run: moveTo("b"), next: []string{"b"}},
+		step{name: "b", run: failWith(fmt.Errorf("boom")), next: []string{models.Clear}, compensate: "undo"},
+		step{name: "undo", run: moveTo(models.Clear), next: []string{models.Clear}},
+	)
+	got, err := sm.run(context.Background(), models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+	if err != nil || got != models.Clear {
+		t.Fatalf("got %s, %v, want %s", got, err, models.Clear)
+	}
+	if !equalStrings(r.compensated, []string{"b"}) {
+		t.Errorf("compensated %v, want [b]", r.compensated)
+	}
+	if !equalStrings(r.persisted, []string{"b", "undo"}) {
+		t.Errorf("persisted %v, want [b undo]", r.persisted)
+	}
+}
+
+func TestStateMachineCancelled(t *testing.T) {
+	r := &recorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	run := func(ctx context.Context, incident *models.DataStoreIncident) (string, error) {
+		cancel()
+		return "b", nil
+	}
+	sm := testMachine(r,
+		step{name: "a", run: run, next: []string{"b"}},
+		step{name: "b", run: moveTo(models.Clear), next: []string{models.Clear}},
+	)
+	got, err := sm.run(ctx, models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+	if got != "b" || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %s, %v, want b, %v", got, err, context.Canceled)
+	}
+}
+
+func TestStateMachineClosed(t *testing.T) {
+	closed := permanent(fmt.Errorf("incident 1: %w", errIncidentClosed))
+	tests := []struct {
+		name        string
+		closeTo     string
+		incident    models.DataStoreIncident
+		want        string
+		wantErr     bool
+		compensated []string
+		messages    int
+	}{
+		{
+			name:     "closed before it was picked up",
+			closeTo:  "undo",
+			incident: models.DataStoreIncident{IncidentID: "1", LastProcess: models.GCFPush, State: models.Closed},
+			want:     "",
+		},
+		{
+			name:     "closed without closeTo is dropped",
+			incident: models.DataStoreIncident{IncidentID: "1", LastProcess: "b", State: models.Closed},
+			want:     "",
+		},
+		{
+			name:        "closed mid way moves to closeTo",
+			closeTo:     "undo",
+			incident:    models.DataStoreIncident{IncidentID: "1", LastProcess: "b"},
+			want:        models.Clear,
+			compensated: []string{"b"},
+			messages:    1,
+		},
+		{
+			name:     "closed mid way without closeTo fails",
+			incident: models.DataStoreIncident{IncidentID: "1", LastProcess: "b"},
+			want:     models.Fail,
+			wantErr:  true,
+		},
+		{
+			name:     "closed on the way to clear fails",
+			closeTo:  "undo",
+			incident: models.DataStoreIncident{IncidentID: "1", LastProcess: "undo-fail"},
+			want:     models.Fail,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			sm := testMachine(r,
+				step{name: models.GCFPush, run: moveTo("b"), next: []string{"b"}},
+				step{name: "b", run: failWith(closed), next: []string{models.Clear}},
+				step{name: "undo", run: moveTo("undo-close"), next: []string{"undo-close", "undo-fail"}},
+				step{name: "undo-close", run: moveTo(models.Clear), next: []string{models.Clear}},
+				step{name: "undo-fail", run: failWith(closed), next: []string{models.Clear}},
+			)
+			sm.onClose(tt.closeTo)
+			got, err := sm.run(context.Background(), tt.incident)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !equalStrings(r.compensated, tt.compensated) {
+				t.Errorf("compensated %v, want %v", r.compensated, tt.compensated)
+			}
+			if r.messages != tt.messages {
+				t.Errorf("sent %d messages, want %d", r.messages, tt.messages)
+			}
+		})
+	}
+}
+
+func TestStateMachineClosing(t *testing.T) {
+	sm := testMachine(&recorder{},
+		step{name: "a", next: []string{"b", "undo"}},
+		step{name: "b", next: []string{models.Clear}},
+		step{name: "undo", next: []string{"undo-close"}},
+		step{name: "undo-close", next: []string{models.Clear}},
+	)
+	if sm.closing("undo") {
+		t.Errorf("closing without closeTo")
+	}
+	sm.onClose("undo")
+	for process, want := range map[string]bool{"a": false, "b": false, "undo": true, "undo-close": true} {
+		if got := sm.closing(process); got != want {
+			t.Errorf("closing(%s) = %v, want %v", process, got, want)
+		}
+	}
+}
+
+func TestStateMachineSuperseded(t *testing.T) {
+	r := &recorder{}
+	sm := testMachine(r,
+		step{name: "a", run: failWith(permanent(fmt.Errorf("incident 1: %w", errIncidentSuperseded))), next: []string{models.Clear}, compensate: "undo"},
+		step{name: "undo", run: moveTo(models.Clear), next: []string{models.Clear}},
+	)
+	got, err := sm.run(context.Background(), models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+	if got != "a" || err != nil {
+		t.Errorf("got %s, %v, want a, nil", got, err)
+	}
+	if len(r.persisted) != 0 || len(r.compensated) != 0 {
+		t.Errorf("superseded incident was touched: persisted %v, compensated %v", r.persisted, r.compensated)
+	}
+}
+
+func TestStateMachinePersistFailure(t *testing.T) {
+	r := &recorder{persistErr: fmt.Errorf("datastore down")}
+	sm := testMachine(r,
+		step{name: "a", run: moveTo("b"), next: []string{"b"}},
+		step{name: "b", run: moveTo(models.Clear), next: []string{models.Clear}},
+	)
+	got, err := sm.run(context.Background(), models.DataStoreIncident{IncidentID: "1", LastProcess: "a"})
+	if got != models.Fail || err == nil {
+		t.Errorf("got %s, %v, want %s and an error", got, err, models.Fail)
+	}
+}
+
+// TestReplicaMachines checks that every step of the add and remove machines
+// moves to a registered step, and where each winds down a closed incident
+func TestReplicaMachines(t *testing.T) {
+	for _, sm := range []*stateMachine{addReplicaMachine, removeReplicaMachine} {
+		for name, s := range sm.steps {
+			targets := append([]string{}, s.next...)
+			if s.compensate != "" {
+				targets = append(targets, s.compensate)
+			}
+			for _, next := range targets {
+				if _, ok := sm.steps[next]; !ok && next != models.Clear {
+					t.Errorf("%s: %s moves to unregistered step %s", sm.name, name, next)
+				}
+			}
+		}
+		if _, ok := sm.steps[sm.closeTo]; !ok {
+			t.Errorf("%s: closes to unregistered step %s", sm.name, sm.closeTo)
+		}
+	}
+	if addReplicaMachine.closeTo != rollbackConfig {
+		t.Errorf("addReplica closes to %s, want %s", addReplicaMachine.closeTo, rollbackConfig)
+	}
+	if removeReplicaMachine.closeTo != models.Closed {
+		t.Errorf("removeReplica closes to %s, want %s", removeReplicaMachine.closeTo, models.Closed)
+	}
+	if !addReplicaMachine.closing(rollbackConfig) || addReplicaMachine.closing(models.InstanceInsert) {
+		t.Errorf("addReplica should wind down from %s but not from %s", rollbackConfig, models.InstanceInsert)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// replicaTemplateKind is the per instance group entity that overrides the settings of new replicas
+const replicaTemplateKind string = "chester_replica_template"
+
+// templateFlag is a database flag set on replicas made from a template
+type templateFlag struct {
+	Name  string
+	Value string
+}
+
+// templateLabel is a user label set on replicas made from a template
+type templateLabel struct {
+	Key   string
+	Value string
+}
+
+// replicaTemplate is stored per instance group to override the settings new
+// replicas copy from the master. Empty fields keep the master's setting or
+// the daemon's default.
+type replicaTemplate struct {
+	// Tier is the machine tier, like db-n1-standard-2
+	Tier string
+	// DataDiskType is PD_SSD or PD_HDD, defaults to PD_SSD
+	DataDiskType string
+	// DataDiskSizeGb is the disk size, it can't be smaller than the master's
+	DataDiskSizeGb int64
+	// DatabaseFlags are set on top of the master's flags, replacing flags with the same name
+	DatabaseFlags []templateFlag
+	// Labels are set on top of the master's labels, the chester labels can't be overridden
+	Labels []templateLabel
+	// MaintenanceWindowDay is the day of the week for maintenance, 1-7 starting
+	// on Monday, 0 lets cloud sql pick
+	MaintenanceWindowDay int64
+	// MaintenanceWindowHour is the hour of the day for maintenance, 0-23
+	MaintenanceWindowHour int64
+	// AvailabilityType is ZONAL or REGIONAL, defaults to ZONAL
+	AvailabilityType string
+	// PricingPlan is PACKAGE or PER_USE, defaults to PACKAGE
+	PricingPlan string
+	// Placement is how the zone of a new replica is picked, spread or any, defaults to spread
+	Placement string
+	// Zones limits the zones new replicas are spread across, empty uses every zone in the region
+	Zones []string
+}
+
+// replicaSpec is everything needed to create a replica
+type replicaSpec struct {
+	Name                  string
+	MasterInstanceName    string
+	Region                string
+	Tier                  string
+	DataDiskType          string
+	DataDiskSizeGb        int64
+	DatabaseFlags         []*sqladmin.DatabaseFlags
+	UserLabels            map[string]string
+	MaintenanceWindowDay  int64
+	MaintenanceWindowHour int64
+	AvailabilityType      string
+	PricingPlan           string
+	// ActivationPolicy is ALWAYS for a running replica or NEVER for a stopped one
+	ActivationPolicy string
+	// Zone is the zone to create the replica in, empty lets cloud sql pick
+	Zone string
+}
+
+// getReplicaTemplate gets the replica template for an instance group
+func getReplicaTemplate(instanceGroup string) (replicaTemplate, error) {
+	template := replicaTemplate{
+		Placement: placementSpread,
+	}
+	err := getGroupSetting(replicaTemplateKind, instanceGroup, &template)
+	return template, err
+}
+
+// buildReplicaSpec works out the settings for a new replica of the master in
+// a region and zone, starting from the master's settings and applying the
+// group's template.
+func buildReplicaSpec(name, region, zone string, master *sqladmin.DatabaseInstance, incident models.DataStoreIncident) (replicaSpec, error) {
+	template, err := getReplicaTemplate(incident.SqlMasterInstance)
+	if err != nil {
+		return replicaSpec{}, err
+	}
+	spec := replicaSpec{
+		Name:               name,
+		MasterInstanceName: incident.SqlMasterInstance,
+		Region:             region,
+		Zone:               zone,
+		Tier:               master.Settings.Tier,
+		DataDiskType:       "PD_SSD",
+		DataDiskSizeGb:     master.Settings.DataDiskSizeGb,
+		AvailabilityType:   "ZONAL",
+		PricingPlan:        "PACKAGE",
+		ActivationPolicy:   "ALWAYS",
+	}
+	if template.Tier != "" {
+		spec.Tier = template.Tier
+	}
+	if template.DataDiskType != "" {
+		spec.DataDiskType = template.DataDiskType
+	}
+	if template.DataDiskSizeGb > spec.DataDiskSizeGb {
+		spec.DataDiskSizeGb = template.DataDiskSizeGb
+	} else if template.DataDiskSizeGb > 0 && template.DataDiskSizeGb < spec.DataDiskSizeGb {
+		log.WithField("incident", incident.IncidentID).Warnf("template disk size %dGB is smaller than the master's, using %dGB", template.DataDiskSizeGb, spec.DataDiskSizeGb)
+	}
+	if template.AvailabilityType != "" {
+		spec.AvailabilityType = template.AvailabilityType
+	}
+	if template.PricingPlan != "" {
+		spec.PricingPlan = template.PricingPlan
+	}
+	spec.MaintenanceWindowDay = template.MaintenanceWindowDay
+	spec.MaintenanceWindowHour = template.MaintenanceWindowHour
+	spec.DatabaseFlags = mergeFlags(master.Settings.DatabaseFlags, template.DatabaseFlags)
+	labels := map[string]string{}
+	for k, v := range master.Settings.UserLabels {
+		labels[k] = v
+	}
+	for _, label := range template.Labels {
+		labels[label.Key] = labelValue(label.Value)
+	}
+	spec.UserLabels = replicaLabels(labels, incident)
+	return spec, nil
+}
+
+// mergeFlags returns the master's flags with the template's flags set on top
+func mergeFlags(masterFlags []*sqladmin.DatabaseFlags, templateFlags []templateFlag) []*sqladmin.DatabaseFlags {
+	flags := []*sqladmin.DatabaseFlags{}
+	overridden := map[string]bool{}
+	for _, flag := range templateFlags {
+		overridden[flag.Name] = true
+	}
+	for _, flag := range masterFlags {
+		if !overridden[flag.Name] {
+			flags = append(flags, flag)
+		}
+	}
+	for _, flag := range templateFlags {
+		flags = append(flags, &sqladmin.DatabaseFlags{Name: flag.Name, Value: flag.Value})
+	}
+	return flags
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	models "github.com/eahrend/chestermodels"
@@ -16,6 +18,41 @@ func generateInstanceName(incident models.DataStoreIncident) string {
 	return instanceName
 }
 
+// groupLabel is the user label chester replicas carry with their instance group
+const groupLabel string = "chester_group"
+
+// incidentLabel is the user label chester replicas carry with the incident that created them
+const incidentLabel string = "chester_incident"
+
+// replicaLabels builds the user labels for a new replica from the master's
+// labels, without modifying the master's map.
+func replicaLabels(masterLabels map[string]string, incident models.DataStoreIncident) map[string]string {
+	labels := map[string]string{}
+	for k, v := range masterLabels {
+		labels[k] = v
+	}
+	labels["chester"] = "true"
+	labels[groupLabel] = labelValue(incident.SqlMasterInstance)
+	labels[incidentLabel] = labelValue(incident.IncidentID)
+	return labels
+}
+
+// labelValue makes a string safe to use as a GCP label value, which only allows
+// lowercase letters, numbers, underscores and dashes, up to 63 characters.
+func labelValue(value string) string {
+	value = strings.ToLower(value)
+	b := []byte(value)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 63 {
+		b = b[:63]
+	}
+	return string(b)
+}
+
 // getPrivateIP is a helper function which returns the private IP address from
 // a list of sqladmin.IpMappings
 func getPrivateIP(IPAddesses []*sqladmin.IpMapping) string {
@@ -27,11 +64,15 @@ func getPrivateIP(IPAddesses []*sqladmin.IpMapping) string {
 	return ""
 }
 
-// coolDownTimer waits 5 minutes between adding/removing a replica
-// and adding/removing a new replica, to prevent us from scaling too fast.
-// TODO: make the timer configurable
-func coolDownTimer(incident models.DataStoreIncident) (string, error) {
-	time.Sleep(5 * time.Minute)
+// coolDownTimer waits between adding/removing a replica and adding/removing
+// a new replica, to prevent us from scaling too fast, then checks whether the
+// incident was closed in the meantime.
+func coolDownTimer(ctx context.Context, incident models.DataStoreIncident, wait time.Duration) (string, error) {
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return models.Fail, ctx.Err()
+	}
 	incidentState, err := getIncidentState(incident.IncidentID)
 	if err != nil {
 		return models.Fail, err
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{name: "already valid", value: "my-db_1", want: "my-db_1"},
+		{name: "uppercase", value: "MyDB", want: "mydb"},
+		{name: "invalid characters", value: "proj:db.name/1", want: "proj_db_name_1"},
+		{name: "empty", value: "", want: ""},
+		{name: "cut to 63 characters", value: strings.Repeat("a", 70), want: strings.Repeat("a", 63)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := labelValue(tt.value); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+)
+
+// rejectedKind is the datastore kind that invalid pubsub messages are quarantined in
+const rejectedKind string = "rejected"
+
+// maxClockSkew is how far in the future an incident's StartedAt may be
+const maxClockSkew = 5 * time.Minute
+
+// knownActions are the actions the daemon knows how to process
+var knownActions = map[string]bool{
+	"add":     true,
+	"remove":  true,
+	"restart": true,
+}
+
+// rejectedMessage is an invalid pubsub message kept in datastore so it can be
+// looked at, instead of crashing the daemon or being silently dropped.
+type rejectedMessage struct {
+	// MessageID is the pubsub message ID
+	MessageID string
+	// IncidentID is the incident ID from the message, if it could be decoded
+	IncidentID string
+	// Payload is the raw message data
+	Payload string `datastore:",noindex"`
+	// Reason is why the message was rejected
+	Reason string `datastore:",noindex"`
+	// RejectedAt is the unix timestamp of when the message was rejected
+	RejectedAt int64
+}
+
+// decodeIncident decodes and validates a pubsub message
+func decodeIncident(data []byte) (models.DataStoreIncident, error) {
+	var m models.DataStoreIncident
+	if len(data) == 0 {
+		return m, fmt.Errorf("message is empty")
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to decode message: %s", err.Error())
+	}
+	return m, validateIncident(m)
+}
+
+// validateIncident checks that an incident has everything the action needs
+func validateIncident(m models.DataStoreIncident) error {
+	if m.Action == "" {
+		return fmt.Errorf("action is required")
+	}
+	if !knownActions[m.Action] {
+		return fmt.Errorf("unknown action %s", m.Action)
+	}
+	if m.SqlMasterInstance == "" {
+		return fmt.Errorf("sql_master_instance is required")
+	}
+	// restarts aren't stored in datastore so they don't need the incident fields
+	if m.Action == "restart" {
+		return nil
+	}
+	if m.IncidentID == "" {
+		return fmt.Errorf("incident_id is required for %s", m.Action)
+	}
+	if strings.HasPrefix(m.IncidentID, "__") && strings.HasSuffix(m.IncidentID, "__") {
+		return fmt.Errorf("incident_id %s is reserved by datastore", m.IncidentID)
+	}
+	if m.Action == "add" && m.ReplicaBaseName == "" {
+		return fmt.Errorf("replica_basename is required for add")
+	}
+	if m.StartedAt <= 0 {
+		return fmt.Errorf("started_at %d is not a valid timestamp", m.StartedAt)
+	}
+	if startedAt := time.Unix(m.StartedAt, 0); startedAt.After(time.Now().Add(maxClockSkew)) {
+		return fmt.Errorf("started_at %s is in the future", startedAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// quarantineMessage stores an invalid message in datastore and lets slack know.
+// The message ID is used as the key, so redeliveries don't create duplicates.
+func quarantineMessage(m *pubsub.Message, incidentID string, reason error) error {
+	log.WithFields(log.Fields{
+		"func":     "quarantineMessage",
+		"incident": incidentID,
+		"message":  m.ID,
+	}).Warnf("rejecting message: %s", reason.Error())
+	key := datastore.NameKey(rejectedKind, m.ID, nil)
+	key.Namespace = "chester"
+	_, err := datastoreClient.Put(ctx, key, &rejectedMessage{
+		MessageID:  m.ID,
+		IncidentID: incidentID,
+		Payload:    string(m.Data),
+		Reason:     reason.Error(),
+		RejectedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	sendMessages([]byte(fmt.Sprintf("Rejected invalid message \n reason: %s \n MessageID: %s \n IncidentID: %s \n Project: %s", reason.Error(), m.ID, incidentID, projectID)))
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+)
+
+func TestValidateIncident(t *testing.T) {
+	now := time.Now().Unix()
+	valid := models.DataStoreIncident{
+		Action:            "add",
+		IncidentID:        "0.abc",
+		SqlMasterInstance: "master",
+		ReplicaBaseName:   "master-replica-",
+		StartedAt:         now,
+	}
+	tests := []struct {
+		name    string
+		change  func(m *models.DataStoreIncident)
+		wantErr string
+	}{
+		{name: "valid add", change: func(m *models.DataStoreIncident) {}},
+		{name: "valid remove without a base name", change: func(m *models.DataStoreIncident) { m.Action = "remove"; m.ReplicaBaseName = "" }},
+		{name: "restart only needs the master", change: func(m *models.DataStoreIncident) {
+			*m = models.DataStoreIncident{Action: "restart", SqlMasterInstance: "master"}
+		}},
+		{name: "missing action", change: func(m *models.DataStoreIncident) { m.Action = "" }, wantErr: "action is required"},
+		{name: "unknown action", change: func(m *models.DataStoreIncident) { m.Action = "resize" }, wantErr: "unknown action"},
+		{name: "missing master", change: func(m *models.DataStoreIncident) { m.SqlMasterInstance = "" }, wantErr: "sql_master_instance"},
+		{name: "missing incident id", change: func(m *models.DataStoreIncident) { m.IncidentID = "" }, wantErr: "incident_id is required"},
+		{name: "reserved incident id", change: func(m *models.DataStoreIncident) { m.IncidentID = "__key__" }, wantErr: "reserved"},
+		{name: "add without a base name", change: func(m *models.DataStoreIncident) { m.ReplicaBaseName = "" }, wantErr: "replica_basename"},
+		{name: "missing started at", change: func(m *models.DataStoreIncident) { m.StartedAt = 0 }, wantErr: "not a valid timestamp"},
+		{name: "started in the future", change: func(m *models.DataStoreIncident) { m.StartedAt = now + 3600 }, wantErr: "in the future"},
+		{name: "started within the clock skew", change: func(m *models.DataStoreIncident) { m.StartedAt = now + 60 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid
+			tt.change(&m)
+			err := validateIncident(m)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %s, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// scaleDownPolicyKind is the per instance group entity that configures scale downs
+const scaleDownPolicyKind string = "chester_scale_down_policy"
+
+const (
+	// victimNewest removes the most recently created replica
+	victimNewest string = "newest"
+	// victimOldest removes the least recently created replica
+	victimOldest string = "oldest"
+	// victimLeastConnections removes the replica with the fewest connections in use across proxysql
+	victimLeastConnections string = "least_connections"
+	// victimMostLag removes the replica furthest behind the master
+	victimMostLag string = "most_lag"
+	// victimZoneBalance removes a replica from the zone with the most replicas
+	victimZoneBalance string = "zone_balance"
+)
+
+// scaleDownPolicy is stored per instance group to configure how replicas are removed
+type scaleDownPolicy struct {
+	// VictimPolicy is the policy used to pick the replica to remove, defaults to newest
+	VictimPolicy string
+	// DrainTimeoutSeconds is how long to wait for connections to drain from a replica
+	// before removing it, defaults to 300. Zero turns draining off.
+	DrainTimeoutSeconds int
+	// RemoveMode is delete to delete removed replicas or park to stop them and
+	// keep them for the next scale up, defaults to delete
+	RemoveMode string
+	// ParkRetentionSeconds is how long a parked replica is kept before it's deleted, defaults to 86400
+	ParkRetentionSeconds int
+}
+
+// victimPolicy picks a replica to remove from an instance group's replicas, and
+// returns the reason it was picked.
+type victimPolicy func(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error)
+
+// victimPolicies are the scale down policies that can be set on an instance group
+var victimPolicies = map[string]victimPolicy{
+	victimNewest:           newestReplica,
+	victimOldest:           oldestReplica,
+	victimLeastConnections: leastConnectionsReplica,
+	victimMostLag:          mostLagReplica,
+	victimZoneBalance:      zoneBalanceReplica,
+}
+
+// getScaleDownPolicy gets the scale down policy for an instance group
+func getScaleDownPolicy(instanceGroup string) (scaleDownPolicy, error) {
+	policy := scaleDownPolicy{
+		VictimPolicy:         victimNewest,
+		DrainTimeoutSeconds:  300,
+		RemoveMode:           removeDelete,
+		ParkRetentionSeconds: 86400,
+	}
+	err := getGroupSetting(scaleDownPolicyKind, instanceGroup, &policy)
+	return policy, err
+}
+
+// selectVictim picks the replica to remove with the instance group's policy.
+// If the policy can't decide, for example because proxysql is unreachable,
+// it falls back to the newest replica. It returns the replica, the policy
+// that picked it and why.
+func selectVictim(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, string, error) {
+	if len(replicas) == 0 {
+		return nil, "", "", fmt.Errorf("no replicas to pick from")
+	}
+	policy, err := getScaleDownPolicy(instanceGroup)
+	if err != nil {
+		return nil, "", "", err
+	}
+	pick, ok := victimPolicies[policy.VictimPolicy]
+	if !ok {
+		return nil, "", "", fmt.Errorf("unknown scale down policy %s", policy.VictimPolicy)
+	}
+	victim, reason, err := pick(instanceGroup, replicas)
+	if err != nil {
+		log.WithField("instanceGroup", instanceGroup).Warnf("scale down policy %s failed, falling back to %s: %s", policy.VictimPolicy, victimNewest, err.Error())
+		victim, reason, _ = newestReplica(instanceGroup, replicas)
+		return victim, victimNewest, fmt.Sprintf("%s failed (%s), %s", policy.VictimPolicy, err.Error(), reason), nil
+	}
+	return victim, policy.VictimPolicy, reason, nil
+}
+
+// sortByCreateTime sorts a copy of the replicas, oldest first. CreateTime is
+// RFC3339 in UTC, so it sorts as a string.
+func sortByCreateTime(replicas []*sqladmin.DatabaseInstance) []*sqladmin.DatabaseInstance {
+	sorted := append([]*sqladmin.DatabaseInstance{}, replicas...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreateTime < sorted[j].CreateTime
+	})
+	return sorted
+}
+
+// newestReplica picks the most recently created replica
+func newestReplica(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error) {
+	sorted := sortByCreateTime(replicas)
+	victim := sorted[len(sorted)-1]
+	return victim, fmt.Sprintf("newest replica, created at %s", victim.CreateTime), nil
+}
+
+// oldestReplica picks the least recently created replica
+func oldestReplica(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error) {
+	victim := sortByCreateTime(replicas)[0]
+	return victim, fmt.Sprintf("oldest replica, created at %s", victim.CreateTime), nil
+}
+
+// leastConnectionsReplica picks the replica with the fewest connections in use,
+// summed across every proxysql pod for the group
+func leastConnectionsReplica(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error) {
+	used, err := proxySQLConnectionsUsed(instanceGroup)
+	if err != nil {
+		return nil, "", err
+	}
+	var victim *sqladmin.DatabaseInstance
+	var least int64
+	for _, replica := range sortByCreateTime(replicas) {
+		connections := used[getPrivateIP(replica.IpAddresses)]
+		// ties go to the newest replica
+		if victim == nil || connections <= least {
+			victim, least = replica, connections
+		}
+	}
+	return victim, fmt.Sprintf("fewest connections in use across proxysql: %d", least), nil
+}
+
+// mostLagReplica picks the replica with the highest Seconds_Behind_Master.
+// Replicas that aren't replicating are picked first, since they're the least useful.
+func mostLagReplica(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error) {
+	psqlConfig, err := getProxySQLConfig(instanceGroup)
+	if err != nil {
+		return nil, "", err
+	}
+	return pickMostLag(replicas, func(replica *sqladmin.DatabaseInstance) (int64, error) {
+		return replicationLag(getPrivateIP(replica.IpAddresses), psqlConfig)
+	})
+}
+
+// pickMostLag picks the replica with the most lag, or the oldest one whose lag
+// couldn't be read. If no replica's lag could be read the problem is more
+// likely the check than the replicas, so it returns an error instead.
+func pickMostLag(replicas []*sqladmin.DatabaseInstance, lagOf func(replica *sqladmin.DatabaseInstance) (int64, error)) (*sqladmin.DatabaseInstance, string, error) {
+	var victim, unknown *sqladmin.DatabaseInstance
+	var unknownErr error
+	var most int64 = -1
+	for _, replica := range sortByCreateTime(replicas) {
+		lag, err := lagOf(replica)
+		if err != nil {
+			if unknown == nil {
+				unknown, unknownErr = replica, err
+			}
+			continue
+		}
+		if lag >= most {
+			victim, most = replica, lag
+		}
+	}
+	if victim == nil {
+		if unknownErr == nil {
+			return nil, "", fmt.Errorf("no replicas to pick from")
+		}
+		return nil, "", fmt.Errorf("replication lag couldn't be read on any replica: %s", unknownErr.Error())
+	}
+	if unknown != nil {
+		return unknown, fmt.Sprintf("replication lag unknown: %s", unknownErr.Error()), nil
+	}
+	return victim, fmt.Sprintf("most replication lag: %d seconds", most), nil
+}
+
+// zoneBalanceReplica picks the newest replica in the zone with the most
+// replicas, so the group stays spread across zones.
+func zoneBalanceReplica(instanceGroup string, replicas []*sqladmin.DatabaseInstance) (*sqladmin.DatabaseInstance, string, error) {
+	zones := map[string]int{}
+	for _, replica := range replicas {
+		zones[replicaZone(replica)]++
+	}
+	var victim *sqladmin.DatabaseInstance
+	for _, replica := range sortByCreateTime(replicas) {
+		if victim == nil || zones[replicaZone(replica)] >= zones[replicaZone(victim)] {
+			victim = replica
+		}
+	}
+	return victim, fmt.Sprintf("zone %s has the most replicas: %d of %d", replicaZone(victim), zones[replicaZone(victim)], len(replicas)), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+func TestPickMostLag(t *testing.T) {
+	replicas := []*sqladmin.DatabaseInstance{
+		{Name: "old", CreateTime: "2021-01-01T00:00:00Z"},
+		{Name: "mid", CreateTime: "2021-01-02T00:00:00Z"},
+		{Name: "new", CreateTime: "2021-01-03T00:00:00Z"},
+	}
+	tests := []struct {
+		name    string
+		lags    map[string]int64
+		want    string
+		wantErr bool
+	}{
+		{name: "most lag", lags: map[string]int64{"old": 1, "mid": 30, "new": 2}, want: "mid"},
+		{name: "ties go to the newest", lags: map[string]int64{"old": 5, "mid": 5, "new": 5}, want: "new"},
+		{name: "not replicating goes first", lags: map[string]int64{"old": 1, "new": 30}, want: "mid"},
+		{name: "no lag could be read", lags: map[string]int64{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victim, _, err := pickMostLag(replicas, func(replica *sqladmin.DatabaseInstance) (int64, error) {
+				lag, ok := tt.lags[replica.Name]
+				if !ok {
+					return 0, fmt.Errorf("%s is not replicating", replica.Name)
+				}
+				return lag, nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && victim.Name != tt.want {
+				t.Errorf("got %s, want %s", victim.Name, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	models "github.com/eahrend/chestermodels"
+	log "github.com/sirupsen/logrus"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// warmPoolKind is the per instance group entity that configures the warm pool
+const warmPoolKind string = "chester_warm_pool"
+
+// poolLabel is the user label marking a chester replica that isn't serving,
+// replicas without it, or with it empty, are in use
+const poolLabel string = "chester_pool"
+
+// poolWarm marks a replica created stopped to be started on a scale up
+const poolWarm string = "warm"
+
+// backgroundTaskTimeout bounds a single background task on a group's pool
+const backgroundTaskTimeout = time.Hour
+
+// poolReconcileInterval is how often the leader tops up every group's warm
+// pool and deletes its expired parked replicas
+var poolReconcileInterval time.Duration
+
+// warmPoolPolicy is stored per instance group to keep stopped replicas ready
+// for scale ups
+type warmPoolPolicy struct {
+	// Size is the number of warm replicas kept in the master's region, 0 turns the pool off
+	Size int
+	// ReplicaBaseName is the base name of warm replicas created outside of a
+	// scale up, defaults to the master's name followed by -replica-
+	ReplicaBaseName string
+}
+
+// backgroundTasks holds the background tasks that are running, keyed by task and instance group
+var backgroundTasks = map[string]bool{}
+
+// backgroundTasksMu guards backgroundTasks
+var backgroundTasksMu sync.Mutex
+
+// getWarmPoolPolicy gets the warm pool policy for an instance group
+func getWarmPoolPolicy(instanceGroup string) (warmPoolPolicy, error) {
+	policy := warmPoolPolicy{}
+	err := getGroupSetting(warmPoolKind, instanceGroup, &policy)
+	return policy, err
+}
+
+// poolState returns the pool a chester replica is in, or an empty string if it's in use
+func poolState(instance *sqladmin.DatabaseInstance) string {
+	if instance.Settings == nil {
+		return ""
+	}
+	return instance.Settings.UserLabels[poolLabel]
+}
+
+// countWarm counts the replicas in the warm pool
+func countWarm(replicas []*sqladmin.DatabaseInstance) int {
+	warm := 0
+	for _, replica := range replicas {
+		if poolState(replica) == poolWarm {
+			warm++
+		}
+	}
+	return warm
+}
+
+// getPoolReplicas returns the instance group's replicas in a pool
+func getPoolReplicas(ctx context.Context, instanceGroup, pool string) ([]*sqladmin.DatabaseInstance, error) {
+	replicas, err := listChesterReplicas(ctx, instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	pooled := []*sqladmin.DatabaseInstance{}
+	for _, replica := range replicas {
+		if poolState(replica) == pool {
+			pooled = append(pooled, replica)
+		}
+	}
+	return pooled, nil
+}
+
+// patchReplicaPool sets a replica's activation policy and pool labels. The
+// patch is queued behind other operations on the master like creates and deletes.
+func patchReplicaPool(ctx context.Context, master string, replica *sqladmin.DatabaseInstance, activationPolicy, pool, parkedAt string) (*sqladmin.Operation, error) {
+	labels := map[string]string{}
+	for k, v := range replica.Settings.UserLabels {
+		labels[k] = v
+	}
+	// empty values rather than missing keys, so the patch clears them
+	labels[poolLabel] = pool
+	labels[parkedAtLabel] = parkedAt
+	rb := &sqladmin.DatabaseInstance{
+		Settings: &sqladmin.Settings{
+			ActivationPolicy: activationPolicy,
+			UserLabels:       labels,
+		},
+	}
+	return scheduleOperation(ctx, master, []string{master, replica.Name}, fmt.Sprintf("set replica %s to %s", replica.Name, activationPolicy), func() (*sqladmin.Operation, error) {
+		var op *sqladmin.Operation
+		err := callSQLAdminMutation(ctx, "instances.patch", func(ctx context.Context) error {
+			var err error
+			op, err = sqlAdminSvc.Instances.Patch(projectID, replica.Name, rb).Context(ctx).Do()
+			return err
+		})
+		return op, err
+	})
+}
+
+// startPooledReplica starts a warm or parked replica claimed by the batch and
+// stores the operation on it. A replica that was already started before a
+// restart is left alone, waitForReplica looks up its operation.
+func startPooledReplica(ctx context.Context, incident *models.DataStoreIncident, replica batchReplica) error {
+	existing, err := findInstance(ctx, replica.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up pooled replica %s with error %s", replica.Name, err.Error())
+	}
+	if existing == nil {
+		return permanent(fmt.Errorf("pooled replica %s no longer exists", replica.Name))
+	}
+	pool := poolState(existing)
+	if pool == "" && existing.Settings.ActivationPolicy == "ALWAYS" {
+		log.WithField("incident", incident.IncidentID).Infof("pooled replica %s is already started, resuming", replica.Name)
+		return nil
+	}
+	sendMessages([]byte(fmt.Sprintf("Starting %s replica %s in %s \n IncidentID: %s \n Database: %s \n Project: %s", pool, replica.Name, replica.Region, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+	op, err := patchReplicaPool(ctx, incident.SqlMasterInstance, existing, "ALWAYS", "", "")
+	if err != nil {
+		return fmt.Errorf("failed to start pooled replica %s with error %s", replica.Name, err.Error())
+	}
+	return updateBatchReplica(incident.IncidentID, replica.Name, func(replica *batchReplica) {
+		replica.OperationID = op.Name
+	})
+}
+
+// availablePooledReplicas returns the group's pooled replicas that have
+// finished being created, so they can be started, by region. Parked replicas
+// come first, most recently parked first since they have the least to catch
+// up on, then warm replicas, oldest first. Parked replicas past the group's
+// retention are left for the expiry to delete.
+func availablePooledReplicas(ctx context.Context, instanceGroup string) (map[string][]*sqladmin.DatabaseInstance, error) {
+	policy, err := getScaleDownPolicy(instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	retention := time.Duration(policy.ParkRetentionSeconds) * time.Second
+	replicas, err := listChesterReplicas(ctx, instanceGroup)
+	if err != nil {
+		return nil, err
+	}
+	parked := []*sqladmin.DatabaseInstance{}
+	warm := []*sqladmin.DatabaseInstance{}
+	for _, replica := range replicas {
+		if replica.State != "RUNNABLE" {
+			continue
+		}
+		switch poolState(replica) {
+		case poolParked:
+			if time.Since(parkedAt(replica)) < retention {
+				parked = append(parked, replica)
+			}
+		case poolWarm:
+			warm = append(warm, replica)
+		}
+	}
+	sort.SliceStable(parked, func(i, j int) bool {
+		return parkedAt(parked[i]).After(parkedAt(parked[j]))
+	})
+	available := map[string][]*sqladmin.DatabaseInstance{}
+	for _, replica := range append(parked, sortByCreateTime(warm)...) {
+		available[replica.Region] = append(available[replica.Region], replica)
+	}
+	return available, nil
+}
+
+// runInBackground runs task for an instance group in the background, unless
+// the same task is already running for the group. Failures are logged, the
+// task is tried again the next time it's started.
+func runInBackground(name, instanceGroup, incidentID string, task func(ctx context.Context) error) {
+	key := name + "/" + instanceGroup
+	backgroundTasksMu.Lock()
+	if backgroundTasks[key] {
+		backgroundTasksMu.Unlock()
+		return
+	}
+	backgroundTasks[key] = true
+	backgroundTasksMu.Unlock()
+	go func() {
+		defer func() {
+			backgroundTasksMu.Lock()
+			delete(backgroundTasks, key)
+			backgroundTasksMu.Unlock()
+		}()
+		taskCtx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+		defer cancel()
+		err := task(taskCtx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"func":     "runInBackground",
+				"task":     name,
+				"incident": incidentID,
+			}).Errorf("failed to %s for %s: %s", name, instanceGroup, err.Error())
+		}
+	}()
+}
+
+// backfillWarmPool tops the instance group's warm pool back up to its size in
+// the background. Only one backfill runs per group at a time.
+func backfillWarmPool(incident models.DataStoreIncident, master *sqladmin.DatabaseInstance) {
+	runInBackground("backfill warm pool", incident.SqlMasterInstance, incident.IncidentID, func(ctx context.Context) error {
+		return fillWarmPool(ctx, incident, master)
+	})
+}
+
+// reconcilePools tops up the warm pool of every instance group, and deletes
+// its expired parked replicas, straight away and then every
+// poolReconcileInterval until ctx is done. It's run by the leader so pools
+// are looked after without waiting for a scale up or a park.
+func reconcilePools(ctx context.Context) {
+	ticker := time.NewTicker(poolReconcileInterval)
+	defer ticker.Stop()
+	for {
+		reconcileAllPools()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileAllPools starts a warm pool backfill and a parked replica expiry
+// for every instance group
+func reconcileAllPools() {
+	funclog := log.WithFields(log.Fields{
+		"func": "reconcileAllPools",
+	})
+	groups, err := getInstanceGroups()
+	if err != nil {
+		funclog.Errorf("failed to list instance groups: %s", err.Error())
+		return
+	}
+	for _, group := range groups {
+		reconcileWarmPool(group)
+		expireParkedReplicas(models.DataStoreIncident{SqlMasterInstance: group})
+	}
+}
+
+// reconcileWarmPool tops an instance group's warm pool up to its size in the
+// background, outside of any incident.
+func reconcileWarmPool(instanceGroup string) {
+	runInBackground("backfill warm pool", instanceGroup, "", func(ctx context.Context) error {
+		policy, err := getWarmPoolPolicy(instanceGroup)
+		if err != nil {
+			return fmt.Errorf("failed to get warm pool policy: %s", err.Error())
+		}
+		if policy.Size <= 0 {
+			return nil
+		}
+		master, err := getInstance(ctx, instanceGroup)
+		if err != nil {
+			return fmt.Errorf("failed to get master: %s", err.Error())
+		}
+		return fillWarmPool(ctx, models.DataStoreIncident{SqlMasterInstance: instanceGroup}, master)
+	})
+}
+
+// fillWarmPool creates stopped replicas in the master's region until the
+// group's warm pool, counting replicas still being created, is at its size.
+// It doesn't wait on the creates. The pool is counted again once each create
+// is at the front of the master's queue, since a scale up or rollback may
+// have started or returned warm replicas while it waited.
+func fillWarmPool(ctx context.Context, incident models.DataStoreIncident, master *sqladmin.DatabaseInstance) error {
+	group := incident.SqlMasterInstance
+	policy, err := getWarmPoolPolicy(group)
+	if err != nil {
+		return fmt.Errorf("failed to get warm pool policy: %s", err.Error())
+	}
+	if policy.Size <= 0 {
+		return nil
+	}
+	if incident.ReplicaBaseName == "" {
+		incident.ReplicaBaseName = policy.ReplicaBaseName
+	}
+	if incident.ReplicaBaseName == "" {
+		incident.ReplicaBaseName = group + "-replica-"
+	}
+	template, err := getReplicaTemplate(group)
+	if err != nil {
+		return fmt.Errorf("failed to get replica template: %s", err.Error())
+	}
+	replicas, err := listChesterReplicas(ctx, group)
+	if err != nil {
+		return fmt.Errorf("failed to list replicas: %s", err.Error())
+	}
+	warm := countWarm(replicas)
+	for ; warm < policy.Size; warm++ {
+		name := generateInstanceName(incident)
+		zone := ""
+		if template.Placement == placementSpread {
+			zone, err = pickZone(group, master.Region, template.Zones, replicas)
+			if err != nil {
+				return err
+			}
+		}
+		spec, err := buildReplicaSpec(name, master.Region, zone, master, incident)
+		if err != nil {
+			return fmt.Errorf("failed to build replica spec: %s", err.Error())
+		}
+		spec.ActivationPolicy = "NEVER"
+		spec.UserLabels[poolLabel] = poolWarm
+		_, err = scheduleOperation(ctx, group, []string{group}, fmt.Sprintf("create warm replica %s", name), func() (*sqladmin.Operation, error) {
+			current, err := listChesterReplicas(ctx, group)
+			if err != nil {
+				return nil, err
+			}
+			if countWarm(current) >= policy.Size {
+				return nil, errOperationSkipped
+			}
+			return insertInstance(ctx, replicaInstance(spec))
+		})
+		if errors.Is(err, errOperationSkipped) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create warm replica %s: %s", name, err.Error())
+		}
+		sendMessages([]byte(fmt.Sprintf("Creating warm replica %s to refill the pool, %d of %d \n IncidentID: %s \n Database: %s \n Project: %s", name, warm+1, policy.Size, incident.IncidentID, incident.SqlMasterInstance, projectID)))
+		replicas = append(replicas, &sqladmin.DatabaseInstance{Name: name, Region: master.Region, GceZone: zone})
+	}
+	return nil
+}